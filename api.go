@@ -1,65 +1,489 @@
 package ufo
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
-var (
-	regin    = make(chan RegisterIn)
-	proofin  = make(chan proof)
-	regout   chan error
-	proofout chan error
+//MaxWait is the longest a read will wait for a new message
+const MaxWait = 30 * time.Second
 
-	chalin    = make(chan ChallengeIn)
-	verifyin  = make(chan SignedFingerPrint)
-	chalout   chan ChallengeOut
-	verifyout chan error
+//MaxBody is the largest request body the server will read
+const MaxBody = 1 << 20
 
-	readin   = make(chan ReadIn)
-	writein  = make(chan WriteIn)
-	readout  chan ReadOut
-	writeout chan error
+//ErrBadRequest is returned when a request
+//body is not the JSON object expected
+var ErrBadRequest = errors.New("Bad request")
 
-	groupin  = make(chan Group)
-	listin   = make(chan ListIn)
-	groupout chan GroupOut
-	listout  chan ListOut
+//ErrNoSuchEndpoint is returned for requests
+//to a path that ufo does not serve
+var ErrNoSuchEndpoint = errors.New("No such endpoint")
 
-	login = make(chan Event)
-)
+//errInternal is a failure that is the server's fault
+var errInternal = errors.New("Internal server error")
+
+//Server is a single ufo instance. It owns the processors
+//that hold its state and serves ufo's HTTP endpoints.
+type Server struct {
+	regin    chan envelope //RegisterIn
+	proofin  chan envelope //proof
+	keyin    chan envelope //[]FingerPrint
+	rotatein chan envelope //RotateIn
+	revokein chan envelope //revocation
+
+	chalin   chan envelope //ChallengeIn
+	verifyin chan envelope //SignedFingerPrint
+	forgetin chan envelope //FingerPrint
+
+	readin    chan envelope //readReq
+	writein   chan envelope //writeReq
+	ackin     chan envelope //AckIn
+	msgmovein chan envelope //move
+	purgein   chan envelope //FingerPrint
+
+	groupin     chan envelope //Group
+	listin      chan envelope //ListIn
+	memberin    chan envelope //Reciept
+	changein    chan envelope //change
+	groupmovein chan envelope //move
+
+	subin   chan envelope //subscription
+	unsubin chan envelope //subscription
+	pubin   chan envelope //publication
+
+	sessionin chan envelope //FingerPrint
+	checkin   chan envelope //string
+	endin     chan envelope //string
+	dropin    chan envelope //FingerPrint
+
+	linkin     chan envelope //link
+	acctlinkin chan envelope //link
+	acctin     chan envelope //FingerPrint
+	devin      chan envelope //[]FingerPrint
+	acctmovein chan envelope //move
+	unlinkin   chan envelope //FingerPrint
+
+	login  chan Event
+	logout chan string
+
+	regload   chan load
+	msgload   chan load
+	convoload chan load
+	acctload  chan load
+
+	admins       map[FingerPrint]bool
+	challengeTTL time.Duration
+	sessionTTL   time.Duration
+	timeout      time.Duration
+
+	store Store //Given to Load, closed with the Server
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	procs  sync.WaitGroup
+
+	draining chan struct{}
+	drained  sync.Once
+	closed   sync.Once
+	err      error //Of closing store
+}
+
+//Option configures a Server, see New
+type Option func(*Server)
+
+//WithAdmins sets the fingerprints of the server's admins,
+//only they may let a revoked key register again.
+func WithAdmins(fps ...FingerPrint) Option {
+	return func(s *Server) {
+		for _, fp := range fps {
+			s.admins[fp] = true
+		}
+	}
+}
+
+//WithChallengeTTL sets how long a challenge may go
+//unanswered before it expires. It defaults to 5 minutes.
+func WithChallengeTTL(d time.Duration) Option {
+	return func(s *Server) { s.challengeTTL = d }
+}
+
+//WithSessionTTL sets how long a session token is valid
+//for after it is issued. It defaults to 24 hours.
+func WithSessionTTL(d time.Duration) Option {
+	return func(s *Server) { s.sessionTTL = d }
+}
+
+//WithTimeout sets how long a request may wait on each
+//step of its work before it gives up with a 504.
+//It defaults to 10 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Server) { s.timeout = d }
+}
+
+//New starts a Server that keeps its state in memory until
+//Load is called. Close stops it.
+func New(opts ...Option) *Server {
+	s := &Server{
+		regin:       make(chan envelope),
+		proofin:     make(chan envelope),
+		keyin:       make(chan envelope),
+		rotatein:    make(chan envelope),
+		revokein:    make(chan envelope),
+		chalin:      make(chan envelope),
+		verifyin:    make(chan envelope),
+		forgetin:    make(chan envelope),
+		readin:      make(chan envelope),
+		writein:     make(chan envelope),
+		ackin:       make(chan envelope),
+		msgmovein:   make(chan envelope),
+		purgein:     make(chan envelope),
+		groupin:     make(chan envelope),
+		listin:      make(chan envelope),
+		memberin:    make(chan envelope),
+		changein:    make(chan envelope),
+		groupmovein: make(chan envelope),
+		subin:       make(chan envelope),
+		unsubin:     make(chan envelope),
+		pubin:       make(chan envelope),
+		sessionin:   make(chan envelope),
+		checkin:     make(chan envelope),
+		endin:       make(chan envelope),
+		dropin:      make(chan envelope),
+		linkin:      make(chan envelope),
+		acctlinkin:  make(chan envelope),
+		acctin:      make(chan envelope),
+		devin:       make(chan envelope),
+		acctmovein:  make(chan envelope),
+		unlinkin:    make(chan envelope),
+
+		login: make(chan Event),
+
+		regload:   make(chan load),
+		msgload:   make(chan load),
+		convoload: make(chan load),
+		acctload:  make(chan load),
+
+		admins:       make(map[FingerPrint]bool),
+		challengeTTL: 5 * time.Minute,
+		sessionTTL:   24 * time.Hour,
+		timeout:      10 * time.Second,
+
+		store:    NewMemStore(),
+		draining: make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	ctx, wg, st := s.ctx, &s.procs, s.store
+	registerProc(ctx, wg, st, s.regin, s.proofin, s.keyin, s.rotatein, s.revokein, s.regload)
+	msgProc(ctx, wg, st, s.readin, s.writein, s.ackin, s.msgmovein, s.purgein, s.msgload)
+	convoProc(ctx, wg, st, s.groupin, s.listin, s.memberin, s.changein, s.groupmovein, s.linkin, s.devin, s.acctlinkin, s.convoload)
+	challengeProc(ctx, wg, s.challengeTTL, s.chalin, s.verifyin, s.forgetin, s.proofin)
+	accountProc(ctx, wg, st, s.acctlinkin, s.acctin, s.devin, s.acctmovein, s.unlinkin, s.acctload)
+	sessionProc(ctx, wg, s.sessionTTL, s.sessionin, s.checkin, s.endin, s.dropin)
+	streamProc(ctx, wg, s.subin, s.unsubin, s.pubin)
+	s.logout = logger(ctx, wg, s.login)
+	s.log(Event{"started", nil})
+	return s
+}
+
+//Drain ends every open stream and waiting read, those
+//requests would otherwise never let an http.Server shut
+//down. Pass it to http.Server.RegisterOnShutdown.
+func (s *Server) Drain() {
+	s.drained.Do(func() { close(s.draining) })
+}
+
+//Close stops the Server's processors, waiting for any
+//change they are making to finish, and then closes the
+//Store given to Load. The Server must not be used after.
+func (s *Server) Close() error {
+	s.closed.Do(func() {
+		s.Drain()
+		s.cancel()
+		s.procs.Wait()
+		s.err = s.store.Close()
+	})
+	return s.err
+}
+
+//Load replaces the Server's state with the contents of st
+//and persists every later change to it. It is meant to be
+//called once at start up, before any requests are served.
+func (s *Server) Load(st Store) error {
+	for _, c := range []chan load{s.regload, s.msgload, s.convoload, s.acctload} {
+		l := load{st, make(chan error)}
+		c <- l
+		if err := <-l.err; err != nil {
+			return err
+		}
+	}
+	s.store = st
+	s.log(Event{"loaded store", nil})
+	return nil
+}
+
+//call hands in to the processor on c and waits for its
+//reply. It gives up when ctx is done, when the Server's
+//timeout passes or when the Server is closed.
+func (s *Server) call(ctx context.Context, c chan envelope, in interface{}) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return send(ctx, s.ctx.Done(), c, in)
+}
+
+//do is call for processors that only reply with an error
+func (s *Server) do(ctx context.Context, c chan envelope, in interface{}) error {
+	out, err := s.call(ctx, c, in)
+	if err != nil {
+		return err
+	}
+	err, _ = out.(error)
+	return err
+}
+
+//post hands in to a processor that does not reply,
+//it is dropped if the Server is closed.
+func (s *Server) post(c chan envelope, in interface{}) {
+	select {
+	case c <- envelope{s.ctx, in, nil}:
+	case <-s.ctx.Done():
+	}
+}
+
+//log records e on the debug page, it
+//is dropped if the Server is closed.
+func (s *Server) log(e Event) {
+	select {
+	case s.login <- e:
+	case <-s.ctx.Done():
+	}
+}
+
+//bearer returns the session token from the
+//Authorization header of r, if there is one.
+func bearer(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+//authenticate checks the session token of r if it has
+//one, otherwise the signed challenge in sfp. On success
+//sfp holds the FingerPrint of the authenticated key and
+//the Account it is a device of, on failure the error is
+//answered with a 401.
+func (s *Server) authenticate(r *http.Request, sfp *SignedFingerPrint) error {
+	ctx := r.Context()
+	if tok := bearer(r); tok != "" {
+		out, err := s.call(ctx, s.checkin, tok)
+		if err != nil {
+			return err
+		}
+		chk := out.(sessionCheck)
+		if chk.err != nil {
+			return unauthorized{chk.err}
+		}
+		//A session issued as its key was rotated or
+		//revoked may have missed being dropped
+		if out, err = s.call(ctx, s.keyin, []FingerPrint{chk.FingerPrint}); err != nil {
+			return err
+		}
+		switch keys := out.([]KeyOut); {
+		case len(keys) == 0:
+			return unauthorized{ErrKeyNotExist}
+		case keys[0].SucceededBy != nil:
+			return unauthorized{ErrKeyRotated}
+		}
+		sfp.FingerPrint = chk.FingerPrint
+	} else {
+		out, err := s.call(ctx, s.verifyin, *sfp)
+		if err != nil {
+			return err
+		}
+		if err, _ = out.(error); err != nil {
+			return denied(err)
+		}
+	}
+	out, err := s.call(ctx, s.acctin, sfp.FingerPrint)
+	if err != nil {
+		return err
+	}
+	sfp.Account = out.(FingerPrint)
+	return nil
+}
+
+//devicesOf returns every device key of each of accounts,
+//anything that is not an account is left out.
+func (s *Server) devicesOf(ctx context.Context, accounts []FingerPrint) (map[FingerPrint][]FingerPrint, error) {
+	out, err := s.call(ctx, s.devin, accounts)
+	if err != nil {
+		return nil, err
+	}
+	return out.(map[FingerPrint][]FingerPrint), nil
+}
+
+//unauthorized is an error from authenticate, unless the
+//cause has a 401 of its own it is answered as ErrAuthDenied
+type unauthorized struct{ error }
+
+func (u unauthorized) Unwrap() error { return u.error }
+
+func (u unauthorized) Is(target error) bool {
+	_, ok := target.(unauthorized)
+	return ok
+}
+
+//denied wraps a failed verification in unauthorized, unless
+//it only failed because the request or Server gave up
+func denied(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || errors.Is(err, ErrClosed) {
+		return err
+	}
+	return unauthorized{err}
+}
+
+//unknownMembers is an ErrUnknownMember
+//listing the members that are unknown
+type unknownMembers []FingerPrint
+
+func (u unknownMembers) Error() string { return fmt.Sprint(ErrUnknownMember, ": ", []FingerPrint(u)) }
+
+func (u unknownMembers) Unwrap() error { return ErrUnknownMember }
+
+//codes maps the errors a request can fail with to
+//their ErrorOut Code and HTTP status, anything not
+//listed is the server's fault and answered as an
+//ErrInternal.
+var codes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{ErrAuthDenied, "ErrAuthDenied", http.StatusUnauthorized},
+	{ErrExpired, "ErrExpired", http.StatusUnauthorized},
+	{ErrKeyRotated, "ErrKeyRotated", http.StatusUnauthorized},
+	{unauthorized{}, "ErrAuthDenied", http.StatusUnauthorized},
+	{ErrKeyNotExist, "ErrKeyNotExist", http.StatusNotFound},
+	{ErrKeyRevoked, "ErrKeyRevoked", http.StatusForbidden},
+	{ErrNotMember, "ErrNotMember", http.StatusForbidden},
+	{ErrNotAllowed, "ErrNotAllowed", http.StatusForbidden},
+	{ErrNoSuchUUID, "ErrNoSuchUUID", http.StatusNotFound},
+	{ErrNoSuchMsg, "ErrNoSuchMsg", http.StatusNotFound},
+	{ErrNoSuchEndpoint, "ErrNoSuchEndpoint", http.StatusNotFound},
+	{ErrKeyExists, "ErrKeyExists", http.StatusConflict},
+	{ErrGroupExists, "ErrGroupExists", http.StatusConflict},
+	{ErrNonceUsed, "ErrNonceUsed", http.StatusConflict},
+	{ErrLinked, "ErrLinked", http.StatusConflict},
+	{ErrTooLarge, "ErrTooLarge", http.StatusRequestEntityTooLarge},
+	{ErrBadUUID, "ErrBadUUID", http.StatusBadRequest},
+	{ErrBadRequest, "ErrBadRequest", http.StatusBadRequest},
+	{ErrBadSig, "ErrBadSig", http.StatusBadRequest},
+	{ErrBadKey, "ErrBadKey", http.StatusBadRequest},
+	{ErrBadEnvelope, "ErrBadEnvelope", http.StatusBadRequest},
+	{ErrUnknownMember, "ErrUnknownMember", http.StatusBadRequest},
+	{ErrUnsupportedKey, "ErrUnsupportedKey", http.StatusBadRequest},
+	{ErrUnsupportedScheme, "ErrUnsupportedScheme", http.StatusBadRequest},
+	{errInternal, "ErrInternal", http.StatusInternalServerError},
+	{ErrStoreFailed, "ErrStoreFailed", http.StatusServiceUnavailable},
+	{ErrClosed, "ErrClosed", http.StatusServiceUnavailable},
+	{context.Canceled, "ErrCanceled", http.StatusServiceUnavailable},
+	{context.DeadlineExceeded, "ErrTimeout", http.StatusGatewayTimeout},
+}
+
+//fail logs err as what went wrong and answers
+//the request with it as a marshalled ErrorOut.
+func (s *Server) fail(w http.ResponseWriter, what string, err error) {
+	s.log(Event{what, err})
+	out := ErrorOut{Code: "ErrInternal", Message: errInternal.Error()}
+	status := http.StatusInternalServerError
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			out.Code, status = c.code, c.status
+			//The details of the server's own failures stay in the log
+			if status < http.StatusInternalServerError {
+				out.Message = err.Error()
+			} else {
+				out.Message = c.err.Error()
+			}
+			break
+		}
+	}
+	var bad unknownMembers
+	if errors.As(err, &bad) {
+		out.Unknown = bad
+	}
+	b, _ := json.Marshal(&out)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+//readBody reads the body of r, failing
+//with ErrTooLarge past MaxBody bytes.
+func readBody(r *http.Request) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBody+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	if len(b) > MaxBody {
+		return nil, ErrTooLarge
+	}
+	return b, nil
+}
 
-func init() {
-	regout, proofout = registerProc(regin, proofin)
-	readout, writeout = msgProc(readin, writein)
-	groupout, listout = convoProc(groupin, listin)
-	chalout, verifyout = challengeProc(chalin, verifyin)
-	logger(login)
-	login <- Event{"started", nil}
+//readIn reads the JSON body of r in to v
+func readIn(r *http.Request, v interface{}) error {
+	b, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	return nil
+}
+
+//member checks fp is a member of group and returns the
+//group. If not an error response is written to w.
+func (s *Server) member(ctx context.Context, w http.ResponseWriter, fp FingerPrint, group string) (Group, bool) {
+	out, err := s.call(ctx, s.memberin, Reciept{fp, group})
+	m, _ := out.(membership)
+	if err == nil {
+		err = m.err
+	}
+	if err != nil {
+		s.fail(w, "Membership", err)
+		return Group{}, false
+	}
+	return m.Group, true
 }
 
 //RegisterInHandler is the endpoint for registration requests
 //it accepts a marshalled RegisterIn struct and returns
 //a 200 status code on success.
-func RegisterInHandler(w http.ResponseWriter, r *http.Request) {
+func (s *Server) RegisterInHandler(w http.ResponseWriter, r *http.Request) {
 	var in RegisterIn
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		login <- Event{"Reading POST", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-		return
-	}
-	err = json.Unmarshal(b, &in)
+	err := readIn(r, &in)
 	if err != nil {
-		login <- Event{"Parsing JSON", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Reading POST", err)
 		return
 	}
-	regin <- in
-	if err = <-regout; err != nil {
-		login <- Event{"Registration", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	if err = s.do(r.Context(), s.regin, in); err != nil {
+		s.fail(w, "Registration", err)
 		return
 	}
 	w.Write([]byte("OK"))
@@ -67,125 +491,817 @@ func RegisterInHandler(w http.ResponseWriter, r *http.Request) {
 
 //ChallengeHandler is the endpoint for challenge requests
 //it accepts a json marshalled ChallengeIn struct and
-//returns a marshalled ChallengeOut on success.
-func ChallengeHandler(w http.ResponseWriter, r *http.Request) {
+//returns a marshalled ChallengeOut on success. Keys
+//that are not registered get a 404.
+func (s *Server) ChallengeHandler(w http.ResponseWriter, r *http.Request) {
 	var in ChallengeIn
-	b, err := ioutil.ReadAll(r.Body)
+	err := readIn(r, &in)
 	if err != nil {
-		login <- Event{"Reading POST", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Reading POST", err)
 		return
 	}
-	err = json.Unmarshal(b, &in)
+	//Only registered keys can hold challenges
+	ctx := r.Context()
+	out, err := s.call(ctx, s.keyin, []FingerPrint{in.FingerPrint})
 	if err != nil {
-		login <- Event{"Parsing JSON", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Challenge", err)
 		return
 	}
-	chalin <- in
-	out := <-chalout
-	if out.UUID == "" {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	if len(out.([]KeyOut)) == 0 {
+		s.fail(w, "Challenge", ErrKeyNotExist)
 		return
 	}
-	b, _ = json.Marshal(&out)
+	out, err = s.call(ctx, s.chalin, in)
+	if err != nil {
+		s.fail(w, "Challenge", err)
+		return
+	}
+	chal := out.(ChallengeOut)
+	if chal.UUID == "" {
+		s.fail(w, "Challenge", errInternal)
+		return
+	}
+	b, _ := json.Marshal(&chal)
 	w.Write(b)
 }
 
+//SessionHandler is the endpoint for starting a session.
+//It accepts a marshalled SessionIn struct and returns a
+//marshalled SessionOut struct on success. The token may be
+//sent as "Authorization: Bearer <token>" in place of a
+//SignedFingerPrint until it expires or is revoked.
+func (s *Server) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	var in SessionIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	ctx := r.Context()
+	out, err := s.call(ctx, s.verifyin, in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	if err, _ = out.(error); err != nil {
+		s.fail(w, "Verification", denied(err))
+		return
+	}
+	if out, err = s.call(ctx, s.sessionin, in.FingerPrint); err != nil {
+		s.fail(w, "Session", err)
+		return
+	}
+	sess := out.(SessionOut)
+	if sess.Token == "" {
+		s.fail(w, "Session", errInternal)
+		return
+	}
+	b, _ := json.Marshal(&sess)
+	w.Write(b)
+}
+
+//LogoutHandler is the endpoint for revoking the
+//session token in the request's Authorization header.
+//It returns a 200 status code on success with a body of "OK"
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.do(r.Context(), s.endin, bearer(r)); err != nil {
+		s.fail(w, "Logout", err)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
 //MakeConvoHandler is the endpoint for creation of
 //conversations, it accepts a json marshalled GroupIn
 //struct and returns a marshalled GroupOut struct on success.
-func MakeConvoHandler(w http.ResponseWriter, r *http.Request) {
+//The creator is always made a member. Every member must have
+//registered a key, if any have not the ErrorOut lists them in
+//Unknown and no group is made.
+func (s *Server) MakeConvoHandler(w http.ResponseWriter, r *http.Request) {
 	var in GroupIn
-	b, err := ioutil.ReadAll(r.Body)
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	in.Group.Owner = in.Account
+	in.Group.Direct = false
+	ctx := r.Context()
+	bad, err := s.unknown(ctx, in.Group.Members)
+	if err == nil && len(bad) != 0 {
+		err = unknownMembers(bad)
+	}
 	if err != nil {
-		login <- Event{"Reading POST", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Creating group", err)
 		return
 	}
-	err = json.Unmarshal(b, &in)
+	out, err := s.call(ctx, s.groupin, in.Group)
+	g, _ := out.(made)
+	if err == nil {
+		err = g.err
+	}
+	if err != nil {
+		s.fail(w, "Creating group", err)
+		return
+	}
+	b, _ := json.Marshal(&g.GroupOut)
+	w.Write(b)
+}
+
+//DMHandler is the endpoint for direct conversations, it
+//accepts a marshalled DMIn struct and returns a marshalled
+//GroupOut struct. The first call for a pair of users makes
+//the conversation, after that whichever of them asks gets
+//the same one back.
+func (s *Server) DMHandler(w http.ResponseWriter, r *http.Request) {
+	var in DMIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	ctx := r.Context()
+	bad, err := s.unknown(ctx, []FingerPrint{in.Member})
+	if err == nil && len(bad) != 0 {
+		err = unknownMembers(bad)
+	}
 	if err != nil {
-		login <- Event{"Parsing JSON", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Starting DM", err)
 		return
 	}
-	verifyin <- in.SignedFingerPrint
-	err = <-verifyout
+	//Either of them may rename it
+	out, err := s.call(ctx, s.groupin, Group{
+		Members: []FingerPrint{in.Account, in.Member},
+		Owner:   in.Account,
+		Roles:   map[FingerPrint]Role{in.Member: RoleAdmin},
+		Direct:  true,
+	})
+	g, _ := out.(made)
+	if err == nil {
+		err = g.err
+	}
 	if err != nil {
-		login <- Event{"Verification", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Starting DM", err)
 		return
 	}
-	groupin <- in.Group
-	out := <-groupout
-	b, _ = json.Marshal(&out)
+	b, _ := json.Marshal(&g.GroupOut)
 	w.Write(b)
 }
 
 //ReadHandler is the endpoint for requesting messages from
 //the server. It accepts a marshalled ReadIn struct and
-//returns a marshalled ReadOut struct on success.
-func ReadHandler(w http.ResponseWriter, r *http.Request) {
+//returns a marshalled ReadOut struct on success. Unless a
+//cursor is given messages are read from after the last one
+//the user acknowledged with AckHandler, so a lost response
+//only means reading them again. Users that are not members
+//of the group get a 403. If Wait is set and there is nothing
+//to read the request is held open until a message arrives
+//or Wait seconds pass.
+func (s *Server) ReadHandler(w http.ResponseWriter, r *http.Request) {
 	var in ReadIn
-	b, err := ioutil.ReadAll(r.Body)
+	err := readIn(r, &in)
 	if err != nil {
-		login <- Event{"Reading POST", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Reading POST", err)
 		return
 	}
-	err = json.Unmarshal(b, &in)
+	err = s.authenticate(r, &in.SignedFingerPrint)
 	if err != nil {
-		login <- Event{"Parsing JSON", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Verification", err)
 		return
 	}
-	verifyin <- in.SignedFingerPrint
-	err = <-verifyout
-	if err != nil {
-		login <- Event{"Verification", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	ctx := r.Context()
+	g, ok := s.member(ctx, w, in.Account, in.GroupID)
+	if !ok {
 		return
 	}
-	readin <- in
-	out := <-readout
-	if out.Err != nil {
-		login <- Event{"Read", out.Err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	req := readReq{ReadIn: in}
+	if g.Reciepts {
+		if req.Share, err = s.devicesOf(ctx, g.Members); err != nil {
+			s.fail(w, "Read", err)
+			return
+		}
+	}
+	var sub subscription
+	if in.Wait > 0 {
+		//Subscribe before reading so no write is missed
+		sub = subscription{in.Account, in.GroupID, make(chan StreamOut, 1)}
+		s.post(s.subin, sub)
+		defer s.post(s.unsubin, sub)
+	}
+	out, err := s.call(ctx, s.readin, req)
+	f, _ := out.(fetched)
+	if err == nil {
+		err = f.err
+	}
+	if err == nil && len(f.Msgs) == 0 && in.Wait > 0 {
+		wait := time.Duration(in.Wait) * time.Second
+		if wait > MaxWait {
+			wait = MaxWait
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-sub.ch:
+			out, err = s.call(ctx, s.readin, req)
+			f, _ = out.(fetched)
+			if err == nil {
+				err = f.err
+			}
+		case <-timer.C:
+		case <-s.draining:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		s.fail(w, "Read", err)
 		return
 	}
-	b, _ = json.Marshal(&out)
+	f.Msgs = addressed(f.Msgs, in.FingerPrint)
+	b, _ := json.Marshal(&f.ReadOut)
 	w.Write(b)
 }
 
 //WriteHandler is the endpoint for writing messages
 //to a group. It accepts a WriteIn struct and returns a
-//200 status code on success with a body of "OK"
-func WriteHandler(w http.ResponseWriter, r *http.Request) {
+//200 status code on success with a body of "OK". Users
+//that are not members of the group, or are only allowed
+//to read it, get a 403. Encrypted messages must carry an
+//Envelope with a key for every member and no Content.
+//Every message is signed by its sender, see Payload.
+func (s *Server) WriteHandler(w http.ResponseWriter, r *http.Request) {
 	var in WriteIn
-	b, err := ioutil.ReadAll(r.Body)
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	ctx := r.Context()
+	g, ok := s.member(ctx, w, in.Account, in.GroupID)
+	if !ok {
+		return
+	}
+	if g.RoleOf(in.Account) == RoleReadOnly {
+		s.fail(w, "Write", ErrNotAllowed)
+		return
+	}
+	if in.Envelope != nil {
+		//Every device gets its own copy of the key
+		var all map[FingerPrint][]FingerPrint
+		if all, err = s.devicesOf(ctx, g.Members); err != nil {
+			s.fail(w, "Write", err)
+			return
+		}
+		var devices []FingerPrint
+		for _, ds := range all {
+			devices = append(devices, ds...)
+		}
+		err = in.Envelope.check(devices)
+		if err == nil && in.Content != "" {
+			err = fmt.Errorf("%w: has plaintext content", ErrBadEnvelope)
+		}
+		if err != nil {
+			s.fail(w, "Write", err)
+			return
+		}
+	}
+	if in.Nonce == "" {
+		err = fmt.Errorf("%w: no nonce", ErrBadSig)
+	} else {
+		err = s.do(ctx, s.proofin, proof{SignedFingerPrint{FingerPrint: in.FingerPrint, SignedChallenge: in.Sig}, string(in.payload())})
+	}
+	if err != nil {
+		s.fail(w, "Write", err)
+		return
+	}
+	out, err := s.call(ctx, s.writein, writeReq{WriteIn: in})
+	wr, _ := out.(written)
+	if err == nil {
+		err = wr.err
+	}
+	if err != nil {
+		s.fail(w, "Write", err)
+		return
+	}
+	s.post(s.pubin, publication{g.Members, StreamOut{in.GroupID, wr.Msg}})
+	w.Write([]byte("OK"))
+}
+
+//AddMemberHandler is the endpoint for adding members to
+//a group. It accepts a marshalled MemberIn struct and
+//returns a 200 status code on success with a body of "OK".
+//Only the group's owner and admins may add members, and
+//only the owner may add them as admins.
+func (s *Server) AddMemberHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeMembers(w, r, opAdd)
+}
+
+//RemoveMemberHandler is the endpoint for removing members
+//from a group. It accepts a marshalled MemberIn struct and
+//returns a 200 status code on success with a body of "OK".
+//The owner may remove anyone, admins only those below them.
+func (s *Server) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeMembers(w, r, opRemove)
+}
+
+//LeaveHandler is the endpoint for leaving a group. It
+//accepts a marshalled MemberIn struct and returns a 200
+//status code on success with a body of "OK". If the owner
+//leaves the longest standing admin, or failing that member,
+//becomes the owner.
+func (s *Server) LeaveHandler(w http.ResponseWriter, r *http.Request) {
+	s.changeMembers(w, r, opLeave)
+}
+
+//changeMembers parses a MemberIn and makes the change op
+func (s *Server) changeMembers(w http.ResponseWriter, r *http.Request, op string) {
+	var in MemberIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	if op == opAdd {
+		var bad []FingerPrint
+		if bad, err = s.unknown(r.Context(), in.Members); err == nil && len(bad) != 0 {
+			err = unknownMembers(bad)
+		}
+		if err != nil {
+			s.fail(w, "Adding members", err)
+			return
+		}
+	}
+	s.commitChange(r.Context(), w, change{Op: op, By: in.Account, GroupID: in.GroupID, Members: in.Members, Role: in.Role})
+}
+
+//unknown returns the fingerprints in fps that are malformed,
+//are not the account of a registered key or were rotated away.
+func (s *Server) unknown(ctx context.Context, fps []FingerPrint) ([]FingerPrint, error) {
+	out, err := s.call(ctx, s.keyin, fps)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[FingerPrint]bool)
+	for _, k := range out.([]KeyOut) {
+		known[k.FingerPrint] = k.SucceededBy == nil
+	}
+	accounts, err := s.devicesOf(ctx, fps)
+	if err != nil {
+		return nil, err
+	}
+	var bad []FingerPrint
+	for _, fp := range fps {
+		if _, ok := accounts[fp]; !ok || !known[fp] || !fp.valid() {
+			bad = append(bad, fp)
+		}
+	}
+	return bad, nil
+}
+
+//RotateHandler is the endpoint for handing a user's identity
+//on to a new key. It accepts a marshalled RotateIn struct,
+//authenticated with the old key, and returns the marshalled
+//Succession on success. Group memberships and roles, read
+//cursors and wrapped envelope keys all move to the new key
+//and the old key can no longer be used.
+func (s *Server) RotateHandler(w http.ResponseWriter, r *http.Request) {
+	var in RotateIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	//A rotated key may only repeat its own succession, which
+	//finishes any moves a failed attempt left undone
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil && !errors.Is(err, ErrKeyRotated) {
+		s.fail(w, "Verification", err)
+		return
+	}
+	out, err := s.call(r.Context(), s.rotatein, in)
+	rot, _ := out.(rotation)
+	if err == nil {
+		err = rot.err
+	}
+	if err != nil {
+		s.fail(w, "Rotation", err)
+		return
+	}
+	//The key has already rotated, carry on with whatever moves
+	//even if the request is given up on
+	ctx := s.ctx
+	s.post(s.dropin, rot.Old)
+	out, err = s.call(ctx, s.acctmovein, move{Old: rot.Old, New: rot.New})
+	acct, _ := out.(linked)
+	if err == nil {
+		err = acct.err
+	}
+	if err != nil {
+		s.fail(w, "Moving devices", err)
+		return
+	}
+	//Only an account's own key is a member, a device
+	//changing leaves the account's groups as they are
+	if acct.Account == rot.New {
+		out, err = s.call(ctx, s.groupmovein, move{Old: rot.Old, New: rot.New})
+		mv, _ := out.(moved)
+		if err == nil {
+			err = mv.err
+		}
+		if err != nil {
+			s.fail(w, "Moving groups", err)
+			return
+		}
+		//Members only see the account change
+		for _, g := range mv.Groups {
+			in := WriteIn{
+				SignedFingerPrint: SignedFingerPrint{FingerPrint: rot.New},
+				GroupID:           g.UUID,
+				Content:           "rotated from " + string(rot.Old),
+			}
+			s.system(writeReq{in, true}, g.Members)
+		}
+	}
+	out, err = s.call(ctx, s.listin, ListIn{SignedFingerPrint{FingerPrint: acct.Account}})
+	if err != nil {
+		s.fail(w, "Moving messages", err)
+		return
+	}
+	m := move{Old: rot.Old, New: rot.New}
+	for _, g := range out.(ListOut).Groups {
+		m.Groups = append(m.Groups, g.UUID)
+	}
+	if err = s.do(ctx, s.msgmovein, m); err != nil {
+		s.fail(w, "Moving messages", err)
+		return
+	}
+	b, _ := json.Marshal(&rot.Succession)
+	w.Write(b)
+}
+
+//LinkHandler is the endpoint for adding a device to an
+//account. It accepts a marshalled LinkIn struct, authenticated
+//as the new device, and returns a 200 status code on success
+//with a body of "OK". From then on the device reads and writes
+//as the account and receives everything sent to it, but keeps
+//its own read cursors. Keys that are in groups or have devices
+//of their own can not be linked.
+func (s *Server) LinkHandler(w http.ResponseWriter, r *http.Request) {
+	var in LinkIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	ctx := r.Context()
+	out, err := s.call(ctx, s.acctin, in.Approver)
+	if err != nil {
+		s.fail(w, "Link approval", err)
+		return
+	}
+	account := out.(FingerPrint)
+	approval := SignedFingerPrint{FingerPrint: in.Approver, SignedChallenge: in.Approval}
+	if err = s.do(ctx, s.proofin, proof{approval, string(LinkPayload(account, in.FingerPrint))}); err != nil {
+		s.fail(w, "Link approval", err)
+		return
+	}
+	if err = s.do(ctx, s.linkin, link{account, in.FingerPrint}); err != nil {
+		s.fail(w, "Linking", err)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+//RevokeHandler is the endpoint for revoking a key. It
+//accepts a marshalled RevokeIn struct and returns a 200
+//status code on success with a body of "OK". The key's
+//challenges and sessions stop working at once, it is
+//removed from all of its groups and it may not register
+//again unless an admin clears it with ClearHandler.
+func (s *Server) RevokeHandler(w http.ResponseWriter, r *http.Request) {
+	var in RevokeIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	ctx := r.Context()
+	if err = s.do(ctx, s.proofin, proof{SignedFingerPrint{FingerPrint: in.FingerPrint, SignedChallenge: in.Sig}, string(RevocationPayload(in.FingerPrint))}); err != nil {
+		s.fail(w, "Revocation", err)
+		return
+	}
+	//Revoking an account takes all of its devices with it, they
+	//go first so none is left linked to nothing but still usable
+	devices, err := s.devicesOf(ctx, []FingerPrint{in.FingerPrint})
+	if err != nil {
+		s.fail(w, "Revocation", err)
+		return
+	}
+	for _, d := range devices[in.FingerPrint] {
+		if d == in.FingerPrint {
+			continue
+		}
+		if err = s.do(ctx, s.revokein, revocation{FingerPrint: d, force: true}); err != nil {
+			s.fail(w, "Revoking devices", fmt.Errorf("%w: %v", errInternal, err))
+			return
+		}
+		s.post(s.forgetin, d)
+		s.post(s.dropin, d)
+	}
+	if err = s.do(ctx, s.revokein, revocation{FingerPrint: in.FingerPrint, Sig: in.Sig}); err != nil {
+		s.fail(w, "Revocation", err)
+		return
+	}
+	//The key is revoked, the rest happens even
+	//if the request is given up on
+	ctx = s.ctx
+	s.post(s.forgetin, in.FingerPrint)
+	s.post(s.dropin, in.FingerPrint)
+	out, err := s.call(ctx, s.unlinkin, in.FingerPrint)
+	un, _ := out.(unlinked)
+	if err == nil {
+		err = un.err
+	}
+	if err != nil {
+		s.fail(w, "Unlinking", fmt.Errorf("%w: %v", errInternal, err))
+		return
+	}
+	//Groups hold accounts, a device on its own leaves none
+	if in.Account == in.FingerPrint {
+		out, err = s.call(ctx, s.listin, ListIn{in.SignedFingerPrint})
+		if err != nil {
+			s.fail(w, "Leaving groups", fmt.Errorf("%w: %v", errInternal, err))
+			return
+		}
+		for _, g := range out.(ListOut).Groups {
+			out, err := s.call(ctx, s.changein, change{Op: opRevoke, By: in.FingerPrint, GroupID: g.UUID})
+			ch, _ := out.(changed)
+			if err == nil {
+				err = ch.err
+			}
+			if err != nil {
+				s.fail(w, "Leaving groups", fmt.Errorf("%w: %v", errInternal, err))
+				return
+			}
+			sys := WriteIn{SignedFingerPrint: in.SignedFingerPrint, GroupID: g.UUID, Content: "revoked"}
+			s.system(writeReq{sys, true}, ch.Members)
+		}
+	}
+	if in.Purge {
+		if err = s.do(ctx, s.purgein, in.FingerPrint); err != nil {
+			s.fail(w, "Purging messages", fmt.Errorf("%w: %v", errInternal, err))
+			return
+		}
+	}
+	w.Write([]byte("OK"))
+}
+
+//ClearHandler is the endpoint for server admins to let a
+//revoked key register again. It accepts a marshalled ClearIn
+//struct and returns a 200 status code on success with a body
+//of "OK", anyone but an admin gets a 403.
+func (s *Server) ClearHandler(w http.ResponseWriter, r *http.Request) {
+	var in ClearIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	if !s.admins[in.Account] {
+		s.fail(w, "Clearing revocation", ErrNotAllowed)
+		return
+	}
+	if err = s.do(r.Context(), s.revokein, revocation{FingerPrint: in.Revoked, clear: true}); err != nil {
+		s.fail(w, "Clearing revocation", err)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+//KeyHandler is the endpoint for looking up a user's public
+//key. It accepts a marshalled KeyIn struct and returns a
+//marshalled KeyOut struct, or a 404 if no key is registered
+//with that fingerprint.
+func (s *Server) KeyHandler(w http.ResponseWriter, r *http.Request) {
+	var in KeyIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	ctx := r.Context()
+	out, err := s.call(ctx, s.keyin, []FingerPrint{in.FingerPrint})
+	if err != nil {
+		s.fail(w, "Key lookup", err)
+		return
+	}
+	keys := out.([]KeyOut)
+	if len(keys) == 0 {
+		s.fail(w, "Key lookup", ErrKeyNotExist)
+		return
+	}
+	if out, err = s.call(ctx, s.acctin, in.FingerPrint); err != nil {
+		s.fail(w, "Key lookup", err)
+		return
+	}
+	keys[0].Account = out.(FingerPrint)
+	b, _ := json.Marshal(&keys[0])
+	w.Write(b)
+}
+
+//KeysHandler is the endpoint for fetching the public keys
+//of every device of every member of a group at once. It
+//accepts a marshalled KeysIn struct and returns a marshalled
+//KeysOut struct, only members of the group may ask.
+func (s *Server) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	var in KeysIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	ctx := r.Context()
+	g, ok := s.member(ctx, w, in.Account, in.GroupID)
+	if !ok {
+		return
+	}
+	ds, err := s.devicesOf(ctx, g.Members)
+	if err != nil {
+		s.fail(w, "Key lookup", err)
+		return
+	}
+	accounts := make(map[FingerPrint]FingerPrint)
+	var devices []FingerPrint
+	for _, a := range g.Members {
+		for _, d := range ds[a] {
+			accounts[d] = a
+			devices = append(devices, d)
+		}
+	}
+	keys, err := s.call(ctx, s.keyin, devices)
+	if err != nil {
+		s.fail(w, "Key lookup", err)
+		return
+	}
+	out := KeysOut{keys.([]KeyOut)}
+	for i := range out.Keys {
+		out.Keys[i].Account = accounts[out.Keys[i].FingerPrint]
+	}
+	b, _ := json.Marshal(&out)
+	w.Write(b)
+}
+
+//RoleHandler is the endpoint for changing the role of a
+//member of a group. It accepts a marshalled RoleIn struct
+//and returns a 200 status code on success with a body of
+//"OK". The owner may give any role, admins may only move
+//users between RoleMember and RoleReadOnly.
+func (s *Server) RoleHandler(w http.ResponseWriter, r *http.Request) {
+	var in RoleIn
+	err := readIn(r, &in)
 	if err != nil {
-		login <- Event{"Reading POST", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Reading POST", err)
 		return
 	}
-	err = json.Unmarshal(b, &in)
+	err = s.authenticate(r, &in.SignedFingerPrint)
 	if err != nil {
-		login <- Event{"Parsing JSON", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Verification", err)
 		return
 	}
-	verifyin <- in.SignedFingerPrint
-	err = <-verifyout
+	s.commitChange(r.Context(), w, change{Op: opRole, By: in.Account, GroupID: in.GroupID, Members: []FingerPrint{in.Member}, Role: in.Role})
+}
+
+//UpdateHandler is the endpoint for changing a group's
+//metadata. It accepts a marshalled MetaIn struct, which
+//replaces all of the metadata, and returns a 200 status
+//code on success with a body of "OK". Only the owner and
+//admins may update a group.
+func (s *Server) UpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var in MetaIn
+	err := readIn(r, &in)
 	if err != nil {
-		login <- Event{"Verification", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Reading POST", err)
 		return
 	}
-	writein <- in
-	out := <-writeout
-	if out != nil {
-		login <- Event{"Write", out}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	s.commitChange(r.Context(), w, change{Op: opMeta, By: in.Account, GroupID: in.GroupID, Meta: in.GroupMeta})
+}
+
+//commitChange makes the change c to a group's members
+//and records it as system messages in the group.
+func (s *Server) commitChange(ctx context.Context, w http.ResponseWriter, c change) {
+	res, err := s.call(ctx, s.changein, c)
+	out, _ := res.(changed)
+	if err == nil {
+		err = out.err
+	}
+	if err != nil {
+		s.fail(w, "Change members", err)
+		return
+	}
+	//Those removed get to see it happen
+	notify := append(append([]FingerPrint(nil), out.Members...), out.Changed...)
+	for _, fp := range out.Changed {
+		content := "added " + string(fp)
+		switch c.Op {
+		case opRemove:
+			content = "removed " + string(fp)
+		case opLeave:
+			content = "left"
+		case opRole:
+			content = "made " + string(fp) + " " + string(out.RoleOf(fp))
+		case opMeta:
+			content = "updated"
+		}
+		sys := WriteIn{GroupID: c.GroupID, Content: content}
+		sys.FingerPrint = c.By
+		s.system(writeReq{sys, true}, notify)
+	}
+	w.Write([]byte("OK"))
+}
+
+//system writes a system message and publishes it to
+//members. The change it records has been made, so it is
+//written even if the request is given up on.
+func (s *Server) system(req writeReq, members []FingerPrint) {
+	out, err := s.call(s.ctx, s.writein, req)
+	wr, _ := out.(written)
+	if err == nil {
+		err = wr.err
+	}
+	if err != nil {
+		s.log(Event{"System message", err})
+		return
+	}
+	s.post(s.pubin, publication{members, StreamOut{req.GroupID, wr.Msg}})
+}
+
+//AckHandler is the endpoint for acknowledging messages.
+//It accepts a marshalled AckIn struct and returns a 200
+//status code on success with a body of "OK", later reads
+//start after the acknowledged message.
+func (s *Server) AckHandler(w http.ResponseWriter, r *http.Request) {
+	var in AckIn
+	err := readIn(r, &in)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	ctx := r.Context()
+	if _, ok := s.member(ctx, w, in.Account, in.GroupID); !ok {
+		return
+	}
+	if err = s.do(ctx, s.ackin, in); err != nil {
+		s.fail(w, "Ack", err)
 		return
 	}
 	w.Write([]byte("OK"))
@@ -193,30 +1309,82 @@ func WriteHandler(w http.ResponseWriter, r *http.Request) {
 
 //ListHandler is the endpoint for users to query what
 //groups they are a part of. It accepts a ListIn struct
-//and returns a ListOut struct.
-func ListHandler(w http.ResponseWriter, r *http.Request) {
+//and returns a ListOut struct describing each group.
+func (s *Server) ListHandler(w http.ResponseWriter, r *http.Request) {
 	var in ListIn
-	b, err := ioutil.ReadAll(r.Body)
+	err := readIn(r, &in)
 	if err != nil {
-		login <- Event{"Reading POST", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Reading POST", err)
 		return
 	}
-	err = json.Unmarshal(b, &in)
+	err = s.authenticate(r, &in.SignedFingerPrint)
 	if err != nil {
-		login <- Event{"Parsing JSON", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "Verification", err)
 		return
 	}
-	verifyin <- in.SignedFingerPrint
-	err = <-verifyout
+	out, err := s.call(r.Context(), s.listin, in)
 	if err != nil {
-		login <- Event{"Verification", err}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		s.fail(w, "List", err)
 		return
 	}
-	listin <- in
-	out := <-listout
-	b, _ = json.Marshal(&out)
+	list := out.(ListOut)
+	b, _ := json.Marshal(&list)
 	w.Write(b)
 }
+
+//StreamHandler is the endpoint for receiving messages as
+//they are written. It accepts a marshalled StreamIn struct,
+//or no body when a session token is used, and responds with
+//a stream of server sent events whose data is a marshalled
+//StreamOut struct, one for every message written to any of
+//the user's groups.
+func (s *Server) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	var in StreamIn
+	b, err := readBody(r)
+	if err != nil {
+		s.fail(w, "Reading POST", err)
+		return
+	}
+	if len(b) != 0 {
+		err = json.Unmarshal(b, &in)
+		if err != nil {
+			s.fail(w, "Parsing JSON", fmt.Errorf("%w: %v", ErrBadRequest, err))
+			return
+		}
+	}
+	err = s.authenticate(r, &in.SignedFingerPrint)
+	if err != nil {
+		s.fail(w, "Verification", err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.fail(w, "Streaming", errInternal)
+		return
+	}
+	sub := subscription{in.Account, "", make(chan StreamOut, 64)}
+	s.post(s.subin, sub)
+	defer s.post(s.unsubin, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case out := <-sub.ch:
+			out.Msg = out.Msg.to(in.FingerPrint)
+			b, _ := json.Marshal(&out)
+			fmt.Fprintf(w, "data: %s\n\n", b)
+		case <-ping.C:
+			w.Write([]byte(": ping\n\n"))
+		case <-s.draining:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
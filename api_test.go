@@ -1,8 +1,13 @@
 package ufo_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -12,7 +17,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/SD-Paranoia/ufo"
 	"github.com/google/uuid"
@@ -51,7 +59,7 @@ func signFingerPrint(t *testing.T, uuid string, key *rsa.PrivateKey) ufo.Sig {
 	return ufo.Sig(sigStr)
 }
 
-func register(t *testing.T) (string, string, *rsa.PrivateKey) {
+func register(t *testing.T, srv *ufo.Server) (string, string, *rsa.PrivateKey) {
 	t.Helper()
 	pub, sig, kp := genKeyPartsRSA(t)
 	m := &ufo.RegisterIn{Public: pub, Sig: ufo.Sig(sig)}
@@ -59,7 +67,7 @@ func register(t *testing.T) (string, string, *rsa.PrivateKey) {
 	require.Nil(t, err)
 	req := httptest.NewRequest(http.MethodPost, "/reg", bytes.NewBuffer(b))
 	w := httptest.NewRecorder()
-	ufo.RegisterInHandler(w, req)
+	srv.RegisterInHandler(w, req)
 	require.Nil(t, err)
 	resp := w.Result()
 	require.Equal(t, 200, resp.StatusCode)
@@ -68,14 +76,25 @@ func register(t *testing.T) (string, string, *rsa.PrivateKey) {
 	return pub, sig, kp
 }
 
-func getChallenge(t *testing.T, pub string) string {
+//sign answers a fresh challenge for the key
+func sign(t *testing.T, srv *ufo.Server, pub string, key *rsa.PrivateKey) ufo.SignedFingerPrint {
+	t.Helper()
+	uuids := getChallenge(t, srv, pub)
+	return ufo.SignedFingerPrint{
+		FingerPrint:     makeFingerPrint(pub),
+		SignedChallenge: signFingerPrint(t, uuids, key),
+		Challenge:       uuids,
+	}
+}
+
+func getChallenge(t *testing.T, srv *ufo.Server, pub string) string {
 	t.Helper()
 	in := &ufo.ChallengeIn{makeFingerPrint(pub)}
 	b, err := json.Marshal(in)
 	require.Nil(t, err)
 	req := httptest.NewRequest(http.MethodPost, "/chal", bytes.NewBuffer(b))
 	w := httptest.NewRecorder()
-	ufo.ChallengeHandler(w, req)
+	srv.ChallengeHandler(w, req)
 	resp := w.Result()
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
@@ -89,8 +108,10 @@ func getChallenge(t *testing.T, pub string) string {
 }
 
 func TestMakeGroup(t *testing.T) {
-	pub, _, kp := register(t)
-	uuids := getChallenge(t, pub)
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	uuids := getChallenge(t, srv, pub)
 	//Attempt to create a new group with ourself; this might become an error later
 	fp := makeFingerPrint(pub)
 	gin := &ufo.GroupIn{
@@ -104,40 +125,41 @@ func TestMakeGroup(t *testing.T) {
 	require.Nil(t, err)
 	req := httptest.NewRequest(http.MethodPost, "/convo", bytes.NewBuffer(b))
 	w := httptest.NewRecorder()
-	ufo.MakeConvoHandler(w, req)
+	srv.MakeConvoHandler(w, req)
 	resp := w.Result()
 	assert.Equal(t, 200, resp.StatusCode)
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 	gout := &ufo.GroupOut{}
 	require.Nil(t, json.Unmarshal(b, gout))
-	assert.Empty(t, gout.Error)
 	_, err = uuid.Parse(gout.UUID)
 	assert.Nil(t, err)
 
 	//Make sure out group list now has our newly created UUID
-	//It is possible for our signed fingerprint to expire, but not likely
 	lin := &ufo.ListIn{
-		gin.SignedFingerPrint,
+		sign(t, srv, pub, kp),
 	}
 	b, err = json.Marshal(lin)
 	require.Nil(t, err)
 	req = httptest.NewRequest(http.MethodPost, "/list", bytes.NewBuffer(b))
 	w = httptest.NewRecorder()
-	ufo.ListHandler(w, req)
+	srv.ListHandler(w, req)
 	resp = w.Result()
 	assert.Equal(t, 200, resp.StatusCode)
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 	lout := &ufo.ListOut{}
 	require.Nil(t, json.Unmarshal(b, lout))
-	assert.Equal(t, 1, len(lout.GroupUUIDs))
-	assert.Equal(t, gout.UUID, lout.GroupUUIDs[0])
+	require.Equal(t, 1, len(lout.Groups))
+	assert.Equal(t, gout.UUID, lout.Groups[0].UUID)
+	assert.False(t, lout.Groups[0].Created.IsZero())
 }
 
 func TestRW(t *testing.T) {
-	pub, _, kp := register(t)
-	uuids := getChallenge(t, pub)
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	uuids := getChallenge(t, srv, pub)
 	//Attempt to create a new group with ourself; this might become an error later
 	fp := makeFingerPrint(pub)
 	gin := &ufo.GroupIn{
@@ -151,26 +173,25 @@ func TestRW(t *testing.T) {
 	require.Nil(t, err)
 	req := httptest.NewRequest(http.MethodPost, "/convo", bytes.NewBuffer(b))
 	w := httptest.NewRecorder()
-	ufo.MakeConvoHandler(w, req)
+	srv.MakeConvoHandler(w, req)
 	resp := w.Result()
 	assert.Equal(t, 200, resp.StatusCode)
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 	gout := &ufo.GroupOut{}
 	require.Nil(t, json.Unmarshal(b, gout))
-	assert.Empty(t, gout.Error)
 
 	const msgContent = "Hello from paranoia land"
 
-	win := &ufo.WriteIn{
-		SignedFingerPrint: gin.SignedFingerPrint,
+	win := signWrite(t, kp, &ufo.WriteIn{
+		SignedFingerPrint: sign(t, srv, pub, kp),
 		GroupID:           gout.UUID,
 		Content:           msgContent,
-	}
+	})
 	b, err = json.Marshal(win)
 	req = httptest.NewRequest(http.MethodPost, "/write", bytes.NewBuffer(b))
 	w = httptest.NewRecorder()
-	ufo.WriteHandler(w, req)
+	srv.WriteHandler(w, req)
 	resp = w.Result()
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
@@ -178,13 +199,13 @@ func TestRW(t *testing.T) {
 	assert.Equal(t, "OK", string(b))
 
 	rin := &ufo.ReadIn{
-		SignedFingerPrint: win.SignedFingerPrint,
+		SignedFingerPrint: sign(t, srv, pub, kp),
 		GroupID:           gout.UUID,
 	}
 	b, err = json.Marshal(rin)
 	req = httptest.NewRequest(http.MethodPost, "/read", bytes.NewBuffer(b))
 	w = httptest.NewRecorder()
-	ufo.ReadHandler(w, req)
+	srv.ReadHandler(w, req)
 	resp = w.Result()
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
@@ -195,10 +216,26 @@ func TestRW(t *testing.T) {
 	assert.Equal(t, msgContent, rout.Msgs[0].Content)
 
 	t.Run("reread", func(t *testing.T) {
+		//Nothing has been acknowledged, the message is read again
+		rin.SignedFingerPrint = sign(t, srv, pub, kp)
+		w := post(t, srv.ReadHandler, "/read", rin)
+		require.Equal(t, 200, w.Code)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		require.Equal(t, 1, len(rout.Msgs))
+
+		w = post(t, srv.AckHandler, "/ack", &ufo.AckIn{
+			SignedFingerPrint: sign(t, srv, pub, kp),
+			GroupID:           gout.UUID,
+			ID:                rout.Msgs[0].ID,
+		})
+		require.Equal(t, 200, w.Code)
+
+		rin.SignedFingerPrint = sign(t, srv, pub, kp)
 		b, err = json.Marshal(rin)
 		req = httptest.NewRequest(http.MethodPost, "/read", bytes.NewBuffer(b))
 		w = httptest.NewRecorder()
-		ufo.ReadHandler(w, req)
+		srv.ReadHandler(w, req)
 		resp = w.Result()
 		b, err = ioutil.ReadAll(resp.Body)
 		require.Nil(t, err)
@@ -210,21 +247,18 @@ func TestRW(t *testing.T) {
 }
 
 func TestRW2(t *testing.T) {
-	pub1, _, kp1 := register(t)
-	uuids1 := getChallenge(t, pub1)
+	srv := ufo.New()
+	defer srv.Close()
+	pub1, _, kp1 := register(t, srv)
+	uuids1 := getChallenge(t, srv, pub1)
 	fp1 := makeFingerPrint(pub1)
 	sfp1 := ufo.SignedFingerPrint{
 		SignedChallenge: signFingerPrint(t, uuids1, kp1),
 		FingerPrint:     fp1,
 	}
 
-	pub2, _, kp2 := register(t)
-	uuids2 := getChallenge(t, pub2)
+	pub2, _, kp2 := register(t, srv)
 	fp2 := makeFingerPrint(pub2)
-	sfp2 := ufo.SignedFingerPrint{
-		SignedChallenge: signFingerPrint(t, uuids2, kp2),
-		FingerPrint:     fp2,
-	}
 
 	gin := &ufo.GroupIn{
 		Group:             ufo.Group{Members: []ufo.FingerPrint{fp1, fp2}},
@@ -234,27 +268,26 @@ func TestRW2(t *testing.T) {
 	require.Nil(t, err)
 	req := httptest.NewRequest(http.MethodPost, "/convo", bytes.NewBuffer(b))
 	w := httptest.NewRecorder()
-	ufo.MakeConvoHandler(w, req)
+	srv.MakeConvoHandler(w, req)
 	resp := w.Result()
 	assert.Equal(t, 200, resp.StatusCode)
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 	gout := &ufo.GroupOut{}
 	require.Nil(t, json.Unmarshal(b, gout))
-	assert.Empty(t, gout.Error)
 
 	const msg1 = "Hello!"
 	const msg2 = "Goodbye!"
 
-	win := &ufo.WriteIn{
-		SignedFingerPrint: sfp1,
+	win := signWrite(t, kp1, &ufo.WriteIn{
+		SignedFingerPrint: sign(t, srv, pub1, kp1),
 		GroupID:           gout.UUID,
 		Content:           msg1,
-	}
+	})
 	b, err = json.Marshal(win)
 	req = httptest.NewRequest(http.MethodPost, "/write", bytes.NewBuffer(b))
 	w = httptest.NewRecorder()
-	ufo.WriteHandler(w, req)
+	srv.WriteHandler(w, req)
 	resp = w.Result()
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
@@ -262,13 +295,13 @@ func TestRW2(t *testing.T) {
 	assert.Equal(t, "OK", string(b))
 
 	rin := &ufo.ReadIn{
-		SignedFingerPrint: win.SignedFingerPrint,
+		SignedFingerPrint: sign(t, srv, pub1, kp1),
 		GroupID:           gout.UUID,
 	}
 	b, err = json.Marshal(rin)
 	req = httptest.NewRequest(http.MethodPost, "/read", bytes.NewBuffer(b))
 	w = httptest.NewRecorder()
-	ufo.ReadHandler(w, req)
+	srv.ReadHandler(w, req)
 	resp = w.Result()
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
@@ -278,15 +311,15 @@ func TestRW2(t *testing.T) {
 	assert.Equal(t, 1, len(rout.Msgs))
 	assert.Equal(t, msg1, rout.Msgs[0].Content)
 
-	win = &ufo.WriteIn{
-		SignedFingerPrint: sfp2,
+	win = signWrite(t, kp2, &ufo.WriteIn{
+		SignedFingerPrint: sign(t, srv, pub2, kp2),
 		GroupID:           gout.UUID,
 		Content:           msg2,
-	}
+	})
 	b, err = json.Marshal(win)
 	req = httptest.NewRequest(http.MethodPost, "/write", bytes.NewBuffer(b))
 	w = httptest.NewRecorder()
-	ufo.WriteHandler(w, req)
+	srv.WriteHandler(w, req)
 	resp = w.Result()
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
@@ -294,13 +327,13 @@ func TestRW2(t *testing.T) {
 	assert.Equal(t, "OK", string(b))
 
 	rin = &ufo.ReadIn{
-		SignedFingerPrint: win.SignedFingerPrint,
+		SignedFingerPrint: sign(t, srv, pub2, kp2),
 		GroupID:           gout.UUID,
 	}
 	b, err = json.Marshal(rin)
 	req = httptest.NewRequest(http.MethodPost, "/read", bytes.NewBuffer(b))
 	w = httptest.NewRecorder()
-	ufo.ReadHandler(w, req)
+	srv.ReadHandler(w, req)
 	resp = w.Result()
 	b, err = ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
@@ -312,10 +345,18 @@ func TestRW2(t *testing.T) {
 	assert.Equal(t, msg2, rout.Msgs[1].Content)
 
 	t.Run("Reread2", func(t *testing.T) {
+		w := post(t, srv.AckHandler, "/ack", &ufo.AckIn{
+			SignedFingerPrint: sign(t, srv, pub2, kp2),
+			GroupID:           gout.UUID,
+			ID:                rout.Msgs[1].ID,
+		})
+		require.Equal(t, 200, w.Code)
+
+		rin.SignedFingerPrint = sign(t, srv, pub2, kp2)
 		b, err = json.Marshal(rin)
 		req = httptest.NewRequest(http.MethodPost, "/read", bytes.NewBuffer(b))
 		w = httptest.NewRecorder()
-		ufo.ReadHandler(w, req)
+		srv.ReadHandler(w, req)
 		resp = w.Result()
 		b, err = ioutil.ReadAll(resp.Body)
 		require.Nil(t, err)
@@ -327,6 +368,8 @@ func TestRW2(t *testing.T) {
 }
 
 func TestRegIn(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
 	pub, sig, _ := genKeyPartsRSA(t)
 	m := &ufo.RegisterIn{Public: pub, Sig: ufo.Sig(sig)}
 	b, err := json.Marshal(m)
@@ -334,7 +377,7 @@ func TestRegIn(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodPost, "/reg", bytes.NewBuffer(b))
 	w := httptest.NewRecorder()
-	ufo.RegisterInHandler(w, req)
+	srv.RegisterInHandler(w, req)
 	resp := w.Result()
 
 	b, err = ioutil.ReadAll(resp.Body)
@@ -342,44 +385,1446 @@ func TestRegIn(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode)
 	assert.Equal(t, "OK", string(b))
 
-	t.Run("Duplicate key", func(t *testing.T) {
-		t.Parallel()
-		w := httptest.NewRecorder()
-		ufo.RegisterInHandler(w, req)
-		resp := w.Result()
-		assert.Equal(t, 400, resp.StatusCode)
+	//Parallel subtests finish before the group, and so before srv is closed
+	t.Run("bad", func(t *testing.T) {
+		t.Run("Duplicate key", func(t *testing.T) {
+			t.Parallel()
+			w := post(t, srv.RegisterInHandler, "/reg", m)
+			assert.Equal(t, 409, w.Code)
+			assert.Equal(t, "ErrKeyExists", failure(t, w).Code)
+		})
+
+		t.Run("nil body", func(t *testing.T) {
+			t.Parallel()
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/reg", nil)
+			srv.RegisterInHandler(w, req)
+			resp := w.Result()
+			assert.Equal(t, 400, resp.StatusCode)
+		})
+
+		t.Run("bad sig", func(t *testing.T) {
+			t.Parallel()
+			w := httptest.NewRecorder()
+			m := &ufo.RegisterIn{Public: pub, Sig: ufo.Sig("chris")}
+			b, err = json.Marshal(m)
+			require.Nil(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/reg", bytes.NewBuffer(b))
+			srv.RegisterInHandler(w, req)
+			resp := w.Result()
+			assert.Equal(t, 400, resp.StatusCode)
+		})
+
+		t.Run("bad key", func(t *testing.T) {
+			t.Parallel()
+			w := httptest.NewRecorder()
+			m := &ufo.RegisterIn{Public: "chris", Sig: ufo.Sig(sig)}
+			b, err = json.Marshal(m)
+			require.Nil(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/reg", bytes.NewBuffer(b))
+			srv.RegisterInHandler(w, req)
+			resp := w.Result()
+			assert.Equal(t, 400, resp.StatusCode)
+		})
+	})
+}
+
+func post(t *testing.T, h http.HandlerFunc, path string, in interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(in)
+	require.Nil(t, err)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(b))
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+func TestNotMember(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub1, _, kp1 := register(t, srv)
+	fp1 := makeFingerPrint(pub1)
+	pub2, _, kp2 := register(t, srv)
+
+	w := post(t, srv.MakeConvoHandler, "/convo", &ufo.GroupIn{
+		Group:             ufo.Group{Members: []ufo.FingerPrint{fp1}},
+		SignedFingerPrint: sign(t, srv, pub1, kp1),
+	})
+	require.Equal(t, 200, w.Code)
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+
+	w = post(t, srv.WriteHandler, "/write", &ufo.WriteIn{
+		SignedFingerPrint: sign(t, srv, pub2, kp2),
+		GroupID:           gout.UUID,
+		Content:           "let me in",
+	})
+	assert.Equal(t, 403, w.Code)
+
+	w = post(t, srv.ReadHandler, "/read", &ufo.ReadIn{
+		SignedFingerPrint: sign(t, srv, pub2, kp2),
+		GroupID:           gout.UUID,
+	})
+	assert.Equal(t, 403, w.Code)
+
+	w = post(t, srv.ReadHandler, "/read", &ufo.ReadIn{
+		SignedFingerPrint: sign(t, srv, pub2, kp2),
+		GroupID:           uuid.New().String(),
+	})
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "ErrNoSuchUUID", failure(t, w).Code)
+}
+
+func TestChallenge(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	fp := makeFingerPrint(pub)
+	list := func(sfp ufo.SignedFingerPrint) int {
+		return post(t, srv.ListHandler, "/list", &ufo.ListIn{sfp}).Code
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		sfp := sign(t, srv, pub, kp)
+		assert.Equal(t, 200, list(sfp))
+		assert.Equal(t, 401, list(sfp))
+	})
+
+	t.Run("outstanding", func(t *testing.T) {
+		u1 := getChallenge(t, srv, pub)
+		u2 := getChallenge(t, srv, pub)
+		//Answered out of order, and without naming the challenge
+		assert.Equal(t, 200, list(ufo.SignedFingerPrint{
+			FingerPrint:     fp,
+			SignedChallenge: signFingerPrint(t, u2, kp),
+		}))
+		assert.Equal(t, 200, list(ufo.SignedFingerPrint{
+			FingerPrint:     fp,
+			SignedChallenge: signFingerPrint(t, u1, kp),
+		}))
+	})
+
+	t.Run("wrong uuid", func(t *testing.T) {
+		u1 := getChallenge(t, srv, pub)
+		u2 := getChallenge(t, srv, pub)
+		assert.Equal(t, 401, list(ufo.SignedFingerPrint{
+			FingerPrint:     fp,
+			SignedChallenge: signFingerPrint(t, u1, kp),
+			Challenge:       u2,
+		}))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		srv := ufo.New(ufo.WithChallengeTTL(time.Millisecond))
+		defer srv.Close()
+		pub, _, kp := register(t, srv)
+		sfp := sign(t, srv, pub, kp)
+		time.Sleep(5 * time.Millisecond)
+		w := post(t, srv.ListHandler, "/list", &ufo.ListIn{sfp})
+		assert.Equal(t, 401, w.Code)
+		assert.Equal(t, "ErrExpired", failure(t, w).Code)
+	})
+}
+
+func TestRegBeforeVerify(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, sig, _ := genKeyPartsRSA(t)
+	_, other, _ := genKeyPartsRSA(t)
+
+	for name, bad := range map[string]ufo.Sig{
+		"bad sig":    ufo.Sig(other),
+		"bad base64": ufo.Sig("!" + sig),
+	} {
+		w := post(t, srv.RegisterInHandler, "/reg", &ufo.RegisterIn{Public: pub, Sig: bad})
+		assert.Equalf(t, 400, w.Code, name)
+	}
+
+	//The real owner must still be able to register
+	w := post(t, srv.RegisterInHandler, "/reg", &ufo.RegisterIn{Public: pub, Sig: ufo.Sig(sig)})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "OK", w.Body.String())
+}
+
+func postAuth(t *testing.T, h http.HandlerFunc, path, tok string, in interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(in)
+	require.Nil(t, err)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(b))
+	req.Header.Set("Authorization", "Bearer "+tok)
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+//failure is the ErrorOut a failed request was answered with
+func failure(t *testing.T, w *httptest.ResponseRecorder) ufo.ErrorOut {
+	t.Helper()
+	var out ufo.ErrorOut
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &out))
+	return out
+}
+
+func startSession(t *testing.T, srv *ufo.Server, pub string, kp *rsa.PrivateKey) string {
+	t.Helper()
+	w := post(t, srv.SessionHandler, "/session", &ufo.SessionIn{sign(t, srv, pub, kp)})
+	require.Equal(t, 200, w.Code)
+	var out ufo.SessionOut
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &out))
+	require.NotEmpty(t, out.Token)
+	return out.Token
+}
+
+func TestSession(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	fp := makeFingerPrint(pub)
+	tok := startSession(t, srv, pub, kp)
+
+	w := postAuth(t, srv.MakeConvoHandler, "/convo", tok, &ufo.GroupIn{
+		Group: ufo.Group{Members: []ufo.FingerPrint{fp}},
+	})
+	require.Equal(t, 200, w.Code)
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+
+	w = postAuth(t, srv.WriteHandler, "/write", tok, signWrite(t, kp, &ufo.WriteIn{
+		GroupID: gout.UUID,
+		Content: "no signatures",
+	}))
+	require.Equal(t, 200, w.Code)
+
+	w = postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: gout.UUID})
+	require.Equal(t, 200, w.Code)
+	rout := &ufo.ReadOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+	require.Equal(t, 1, len(rout.Msgs))
+	assert.Equal(t, fp, rout.Msgs[0].From)
+
+	w = postAuth(t, srv.ListHandler, "/list", tok, &ufo.ListIn{})
+	require.Equal(t, 200, w.Code)
+	lout := &ufo.ListOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	require.Equal(t, 1, len(lout.Groups))
+	assert.Equal(t, gout.UUID, lout.Groups[0].UUID)
+
+	t.Run("bad token", func(t *testing.T) {
+		w := postAuth(t, srv.ListHandler, "/list", "chris", &ufo.ListIn{})
+		assert.Equal(t, 401, w.Code)
+		assert.Equal(t, "ErrAuthDenied", failure(t, w).Code)
+	})
+
+	t.Run("replayed challenge", func(t *testing.T) {
+		sfp := sign(t, srv, pub, kp)
+		require.Equal(t, 200, post(t, srv.SessionHandler, "/session", &ufo.SessionIn{sfp}).Code)
+		assert.Equal(t, 401, post(t, srv.SessionHandler, "/session", &ufo.SessionIn{sfp}).Code)
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		w := postAuth(t, srv.LogoutHandler, "/logout", tok, nil)
+		require.Equal(t, 200, w.Code)
+		w = postAuth(t, srv.ListHandler, "/list", tok, &ufo.ListIn{})
+		assert.Equal(t, 401, w.Code)
+		w = postAuth(t, srv.LogoutHandler, "/logout", tok, nil)
+		assert.Equal(t, 401, w.Code)
 	})
 
-	t.Run("nil body", func(t *testing.T) {
-		t.Parallel()
-		w := httptest.NewRecorder()
-		req := httptest.NewRequest(http.MethodPost, "/reg", nil)
-		ufo.RegisterInHandler(w, req)
-		resp := w.Result()
-		assert.Equal(t, 400, resp.StatusCode)
+	t.Run("expired", func(t *testing.T) {
+		srv := ufo.New(ufo.WithSessionTTL(time.Millisecond))
+		defer srv.Close()
+		pub, _, kp := register(t, srv)
+		tok := startSession(t, srv, pub, kp)
+		time.Sleep(5 * time.Millisecond)
+		w := postAuth(t, srv.ListHandler, "/list", tok, &ufo.ListIn{})
+		assert.Equal(t, 401, w.Code)
+		assert.Equal(t, "ErrExpired", failure(t, w).Code)
 	})
+}
+
+//signAny signs msg the way ufo expects for the type of key
+func signAny(t *testing.T, key crypto.Signer, msg []byte) ufo.Sig {
+	t.Helper()
+	digest, opts := msg, crypto.SignerOpts(crypto.Hash(0))
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		hashed := sha256.Sum256(msg)
+		digest, opts = hashed[:], crypto.SHA256
+	}
+	sig, err := key.Sign(rand.Reader, digest, opts)
+	require.Nil(t, err)
+	return ufo.Sig(base64.StdEncoding.EncodeToString(sig))
+}
+
+//signWrite gives in a fresh nonce and signs it with key
+func signWrite(t *testing.T, key crypto.Signer, in *ufo.WriteIn) *ufo.WriteIn {
+	t.Helper()
+	in.Nonce = uuid.New().String()
+	content := in.Content
+	if in.Envelope != nil {
+		content = in.Envelope.Ciphertext
+	}
+	in.Sig = signAny(t, key, ufo.Payload(in.GroupID, in.Nonce, content))
+	return in
+}
+
+func TestKeyTypes(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	_, edkey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.Nil(t, err)
+	_, _, rsakey := genKeyPartsRSA(t)
+	_, _, psskey := genKeyPartsRSA(t)
+
+	for _, tc := range []struct {
+		name   string
+		alg    ufo.Algorithm
+		scheme ufo.Scheme
+		key    crypto.Signer
+		ok     bool
+	}{
+		{"ed25519", ufo.AlgEd25519, "", edkey, true},
+		{"ecdsa", ufo.AlgECDSA, "", eckey, true},
+		{"p384", ufo.AlgECDSA, "", p384, false},
+		{"rsa", ufo.AlgRSA, "", rsakey, true},
+		{"pss", ufo.AlgRSA, ufo.SchemePSS, psskey, true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			sign := func(msg []byte) ufo.Sig {
+				if tc.scheme != ufo.SchemePSS {
+					return signAny(t, tc.key, msg)
+				}
+				hashed := sha256.Sum256(msg)
+				sig, err := tc.key.Sign(rand.Reader, hashed[:], &rsa.PSSOptions{Hash: crypto.SHA256})
+				require.Nil(t, err)
+				return ufo.Sig(base64.StdEncoding.EncodeToString(sig))
+			}
+			pub, err := ufo.EncodePublicKey(tc.key.Public())
+			require.Nil(t, err)
+			m := &ufo.RegisterIn{
+				Public: pub,
+				Sig:    sign([]byte(pub)),
+				Alg:    tc.alg,
+				Scheme: tc.scheme,
+			}
+			w := post(t, srv.RegisterInHandler, "/reg", m)
+			if !tc.ok {
+				assert.Equal(t, 400, w.Code)
+				return
+			}
+			require.Equal(t, 200, w.Code)
+
+			uuids := getChallenge(t, srv, pub)
+			sfp := ufo.SignedFingerPrint{
+				FingerPrint:     makeFingerPrint(pub),
+				SignedChallenge: sign([]byte(uuids)),
+				Challenge:       uuids,
+			}
+			assert.Equal(t, 200, post(t, srv.ListHandler, "/list", &ufo.ListIn{sfp}).Code)
+
+			//Signed with the wrong key
+			uuids = getChallenge(t, srv, pub)
+			sfp.SignedChallenge = signAny(t, p384, []byte(uuids))
+			sfp.Challenge = uuids
+			assert.Equal(t, 401, post(t, srv.ListHandler, "/list", &ufo.ListIn{sfp}).Code)
+
+			//Every kind of key fails the same way
+			key, err := ufo.ParsePublicKey(pub)
+			require.Nil(t, err)
+			require.Nil(t, key.SetScheme(tc.scheme))
+			sig, err := base64.StdEncoding.DecodeString(string(signAny(t, p384, []byte(pub))))
+			require.Nil(t, err)
+			assert.Equal(t, ufo.ErrBadSig, key.Verify([]byte(pub), sig))
+		})
+	}
 
-	t.Run("bad sig", func(t *testing.T) {
-		t.Parallel()
-		w := httptest.NewRecorder()
-		m := &ufo.RegisterIn{Public: pub, Sig: ufo.Sig("chris")}
-		b, err = json.Marshal(m)
+	t.Run("alg mismatch", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 		require.Nil(t, err)
-		req := httptest.NewRequest(http.MethodPost, "/reg", bytes.NewBuffer(b))
-		ufo.RegisterInHandler(w, req)
-		resp := w.Result()
-		assert.Equal(t, 400, resp.StatusCode)
+		pub, err := ufo.EncodePublicKey(key.Public())
+		require.Nil(t, err)
+		m := &ufo.RegisterIn{
+			Public: pub,
+			Sig:    signAny(t, key, []byte(pub)),
+			Alg:    ufo.AlgRSA,
+		}
+		assert.Equal(t, 400, post(t, srv.RegisterInHandler, "/reg", m).Code)
+		m.Alg = ufo.AlgECDSA
+		assert.Equal(t, 200, post(t, srv.RegisterInHandler, "/reg", m).Code)
 	})
+}
 
-	t.Run("bad key", func(t *testing.T) {
-		t.Parallel()
-		w := httptest.NewRecorder()
-		m := &ufo.RegisterIn{Public: "chris", Sig: ufo.Sig(sig)}
-		b, err = json.Marshal(m)
+func TestPSS(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	pub, err := ufo.EncodePublicRSA(&key.PublicKey)
+	require.Nil(t, err)
+	signPSS := func(msg string) ufo.Sig {
+		hashed := sha256.Sum256([]byte(msg))
+		sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, hashed[:], nil)
+		require.Nil(t, err)
+		return ufo.Sig(base64.StdEncoding.EncodeToString(sig))
+	}
+
+	m := &ufo.RegisterIn{Public: pub, Sig: signAny(t, key, []byte(pub)), Scheme: ufo.SchemePSS}
+	assert.Equal(t, 400, post(t, srv.RegisterInHandler, "/reg", m).Code)
+	m.Sig = signPSS(pub)
+	require.Equal(t, 200, post(t, srv.RegisterInHandler, "/reg", m).Code)
+
+	uuids := getChallenge(t, srv, pub)
+	sfp := ufo.SignedFingerPrint{
+		FingerPrint:     makeFingerPrint(pub),
+		SignedChallenge: signFingerPrint(t, uuids, key),
+		Challenge:       uuids,
+	}
+	assert.Equal(t, 401, post(t, srv.ListHandler, "/list", &ufo.ListIn{sfp}).Code)
+	sfp.SignedChallenge = signPSS(uuids)
+	assert.Equal(t, 200, post(t, srv.ListHandler, "/list", &ufo.ListIn{sfp}).Code)
+
+	t.Run("not rsa", func(t *testing.T) {
+		_, edkey, err := ed25519.GenerateKey(rand.Reader)
+		require.Nil(t, err)
+		pub, err := ufo.EncodePublicKey(edkey.Public())
 		require.Nil(t, err)
-		req := httptest.NewRequest(http.MethodPost, "/reg", bytes.NewBuffer(b))
-		ufo.RegisterInHandler(w, req)
-		resp := w.Result()
-		assert.Equal(t, 400, resp.StatusCode)
+		m := &ufo.RegisterIn{Public: pub, Sig: signAny(t, edkey, []byte(pub)), Scheme: ufo.SchemePSS}
+		assert.Equal(t, 400, post(t, srv.RegisterInHandler, "/reg", m).Code)
+	})
+}
+
+//makeGroup creates a group of members owned by the session tok
+func makeGroup(t *testing.T, srv *ufo.Server, tok string, members ...ufo.FingerPrint) string {
+	t.Helper()
+	w := postAuth(t, srv.MakeConvoHandler, "/convo", tok, &ufo.GroupIn{
+		Group: ufo.Group{Members: members},
+	})
+	require.Equal(t, 200, w.Code)
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+	return gout.UUID
+}
+
+func ack(t *testing.T, srv *ufo.Server, tok, group string, id uint64) {
+	t.Helper()
+	w := postAuth(t, srv.AckHandler, "/ack", tok, &ufo.AckIn{GroupID: group, ID: id})
+	require.Equal(t, 200, w.Code)
+}
+
+func TestLongPoll(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	fp := makeFingerPrint(pub)
+	tok := startSession(t, srv, pub, kp)
+	group := makeGroup(t, srv, tok, fp)
+
+	done := make(chan *httptest.ResponseRecorder)
+	start := time.Now()
+	go func() {
+		done <- postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: group, Wait: 10})
+	}()
+	time.Sleep(100 * time.Millisecond)
+	w := postAuth(t, srv.WriteHandler, "/write", tok, signWrite(t, kp, &ufo.WriteIn{GroupID: group, Content: "wake up"}))
+	require.Equal(t, 200, w.Code)
+
+	w = <-done
+	assert.True(t, time.Since(start) < 5*time.Second)
+	require.Equal(t, 200, w.Code)
+	rout := &ufo.ReadOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+	require.Equal(t, 1, len(rout.Msgs))
+	assert.Equal(t, "wake up", rout.Msgs[0].Content)
+
+	t.Run("timeout", func(t *testing.T) {
+		ack(t, srv, tok, group, rout.Msgs[0].ID)
+		start := time.Now()
+		w := postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: group, Wait: 1})
+		require.Equal(t, 200, w.Code)
+		assert.True(t, time.Since(start) >= time.Second)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		assert.Equal(t, 0, len(rout.Msgs))
 	})
 }
+
+func TestStream(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub1, _, kp1 := register(t, srv)
+	fp1 := makeFingerPrint(pub1)
+	tok1 := startSession(t, srv, pub1, kp1)
+	pub2, _, kp2 := register(t, srv)
+	fp2 := makeFingerPrint(pub2)
+	tok2 := startSession(t, srv, pub2, kp2)
+	group := makeGroup(t, srv, tok1, fp1, fp2)
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/stream", nil)
+	require.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+tok2)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	w := postAuth(t, srv.WriteHandler, "/write", tok1, signWrite(t, kp1, &ufo.WriteIn{GroupID: group, Content: "pushed"}))
+	require.Equal(t, 200, w.Code)
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(line, "data: "))
+	var out ufo.StreamOut
+	require.Nil(t, json.Unmarshal([]byte(line[len("data: "):]), &out))
+	assert.Equal(t, group, out.GroupID)
+	assert.Equal(t, fp1, out.From)
+	assert.Equal(t, "pushed", out.Content)
+}
+
+func TestHistory(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	fp := makeFingerPrint(pub)
+	tok := startSession(t, srv, pub, kp)
+	group := makeGroup(t, srv, tok, fp)
+	for _, c := range []string{"1", "2", "3", "4", "5"} {
+		w := postAuth(t, srv.WriteHandler, "/write", tok, signWrite(t, kp, &ufo.WriteIn{GroupID: group, Content: c}))
+		require.Equal(t, 200, w.Code)
+	}
+	cursor := func(i uint64) *uint64 { return &i }
+	read := func(in *ufo.ReadIn) []string {
+		t.Helper()
+		in.GroupID = group
+		w := postAuth(t, srv.ReadHandler, "/read", tok, in)
+		require.Equal(t, 200, w.Code)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		out := []string{}
+		for _, m := range rout.Msgs {
+			assert.Equal(t, m.Content, strconv.FormatUint(m.ID, 10))
+			assert.False(t, m.Time.IsZero())
+			out = append(out, m.Content)
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, read(&ufo.ReadIn{After: cursor(0)}))
+	assert.Equal(t, []string{"3", "4"}, read(&ufo.ReadIn{After: cursor(2), Limit: 2}))
+	assert.Equal(t, []string{"3", "4"}, read(&ufo.ReadIn{Before: cursor(5), Limit: 2}))
+	assert.Equal(t, []string{"2", "3"}, read(&ufo.ReadIn{After: cursor(1), Before: cursor(4)}))
+	assert.Equal(t, []string{}, read(&ufo.ReadIn{After: cursor(5)}))
+	assert.Equal(t, []string{}, read(&ufo.ReadIn{Before: cursor(1)}))
+
+	assert.Equal(t, []string{"1", "2"}, read(&ufo.ReadIn{Limit: 2}))
+	ack(t, srv, tok, group, 2)
+	assert.Equal(t, []string{"3", "4", "5"}, read(&ufo.ReadIn{}))
+	ack(t, srv, tok, group, 5)
+	assert.Equal(t, []string{}, read(&ufo.ReadIn{}))
+}
+
+func TestAck(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub1, _, kp1 := register(t, srv)
+	fp1 := makeFingerPrint(pub1)
+	tok1 := startSession(t, srv, pub1, kp1)
+	pub2, _, kp2 := register(t, srv)
+	fp2 := makeFingerPrint(pub2)
+	tok2 := startSession(t, srv, pub2, kp2)
+
+	w := postAuth(t, srv.MakeConvoHandler, "/convo", tok1, &ufo.GroupIn{
+		Group: ufo.Group{Members: []ufo.FingerPrint{fp1, fp2}, Reciepts: true},
+	})
+	require.Equal(t, 200, w.Code)
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+	group := gout.UUID
+	for _, c := range []string{"a", "b", "c"} {
+		w := postAuth(t, srv.WriteHandler, "/write", tok1, signWrite(t, kp1, &ufo.WriteIn{GroupID: group, Content: c}))
+		require.Equal(t, 200, w.Code)
+	}
+
+	read := func(tok string) *ufo.ReadOut {
+		t.Helper()
+		w := postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: group})
+		require.Equal(t, 200, w.Code)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		return rout
+	}
+
+	rout := read(tok2)
+	assert.Equal(t, 3, len(rout.Msgs))
+	assert.Equal(t, map[ufo.FingerPrint]uint64{fp1: 0, fp2: 0}, rout.Reciepts)
+
+	ack(t, srv, tok2, group, 2)
+	rout = read(tok2)
+	require.Equal(t, 1, len(rout.Msgs))
+	assert.Equal(t, "c", rout.Msgs[0].Content)
+	assert.Equal(t, uint64(2), read(tok1).Reciepts[fp2])
+
+	//Acknowledging backwards is a no-op
+	ack(t, srv, tok2, group, 1)
+	assert.Equal(t, 1, len(read(tok2).Msgs))
+
+	w = postAuth(t, srv.AckHandler, "/ack", tok2, &ufo.AckIn{GroupID: group, ID: 4})
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "ErrNoSuchMsg", failure(t, w).Code)
+
+	t.Run("no reciepts", func(t *testing.T) {
+		group := makeGroup(t, srv, tok1, fp1, fp2)
+		w := postAuth(t, srv.ReadHandler, "/read", tok2, &ufo.ReadIn{GroupID: group})
+		require.Equal(t, 200, w.Code)
+		assert.NotContains(t, w.Body.String(), "Reciepts")
+	})
+}
+
+func TestMembers(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	fpA := makeFingerPrint(pubA)
+	tokA := startSession(t, srv, pubA, kpA)
+	pubB, _, kpB := register(t, srv)
+	fpB := makeFingerPrint(pubB)
+	tokB := startSession(t, srv, pubB, kpB)
+	pubC, _, kpC := register(t, srv)
+	fpC := makeFingerPrint(pubC)
+	tokC := startSession(t, srv, pubC, kpC)
+	group := makeGroup(t, srv, tokA, fpA, fpB)
+
+	change := func(h http.HandlerFunc, tok string, members ...ufo.FingerPrint) int {
+		t.Helper()
+		return postAuth(t, h, "/convo", tok, &ufo.MemberIn{GroupID: group, Members: members}).Code
+	}
+	canRead := func(tok string) bool {
+		t.Helper()
+		return postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: group}).Code == 200
+	}
+
+	assert.Equal(t, 403, change(srv.AddMemberHandler, tokB, fpC))
+	assert.False(t, canRead(tokC))
+	assert.Equal(t, 200, change(srv.AddMemberHandler, tokA, fpC))
+	assert.True(t, canRead(tokC))
+
+	w := postAuth(t, srv.ReadHandler, "/read", tokC, &ufo.ReadIn{GroupID: group})
+	rout := &ufo.ReadOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+	require.Equal(t, 1, len(rout.Msgs))
+	assert.True(t, rout.Msgs[0].System)
+	assert.Equal(t, fpA, rout.Msgs[0].From)
+	assert.Equal(t, "added "+string(fpC), rout.Msgs[0].Content)
+
+	assert.Equal(t, 403, change(srv.RemoveMemberHandler, tokC, fpB))
+	assert.Equal(t, 403, change(srv.RemoveMemberHandler, tokA, fpA))
+	assert.Equal(t, 200, change(srv.RemoveMemberHandler, tokA, fpB))
+	assert.False(t, canRead(tokB))
+
+	lout := &ufo.ListOut{}
+	w = postAuth(t, srv.ListHandler, "/list", tokB, &ufo.ListIn{})
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	assert.Empty(t, lout.Groups)
+
+	//The owner leaving hands the group on
+	assert.Equal(t, 200, change(srv.LeaveHandler, tokA))
+	assert.False(t, canRead(tokA))
+	assert.Equal(t, 200, change(srv.AddMemberHandler, tokC, fpB))
+	assert.Equal(t, 200, change(srv.LeaveHandler, tokB))
+	assert.Equal(t, 403, change(srv.LeaveHandler, tokB))
+
+	w = postAuth(t, srv.ReadHandler, "/read", tokC, &ufo.ReadIn{GroupID: group})
+	rout = &ufo.ReadOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+	var log []string
+	for _, m := range rout.Msgs {
+		assert.True(t, m.System)
+		log = append(log, m.Content)
+	}
+	assert.Equal(t, []string{
+		"added " + string(fpC),
+		"removed " + string(fpB),
+		"left",
+		"added " + string(fpB),
+		"left",
+	}, log)
+}
+
+func TestRoles(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	type user struct {
+		fp  ufo.FingerPrint
+		tok string
+		key *rsa.PrivateKey
+	}
+	users := make([]user, 5)
+	for i := range users {
+		pub, _, kp := register(t, srv)
+		users[i] = user{makeFingerPrint(pub), startSession(t, srv, pub, kp), kp}
+	}
+	a, b, c, d, e := users[0], users[1], users[2], users[3], users[4]
+
+	w := postAuth(t, srv.MakeConvoHandler, "/convo", a.tok, &ufo.GroupIn{
+		Group: ufo.Group{
+			Members: []ufo.FingerPrint{a.fp, b.fp, c.fp, d.fp},
+			Roles: map[ufo.FingerPrint]ufo.Role{
+				b.fp: ufo.RoleAdmin,
+				c.fp: ufo.RoleReadOnly,
+			},
+		},
+	})
+	require.Equal(t, 200, w.Code)
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+	group := gout.UUID
+
+	write := func(u user) int {
+		t.Helper()
+		return postAuth(t, srv.WriteHandler, "/write", u.tok, signWrite(t, u.key, &ufo.WriteIn{GroupID: group, Content: "hi"})).Code
+	}
+	add := func(by user, role ufo.Role, members ...ufo.FingerPrint) int {
+		t.Helper()
+		return postAuth(t, srv.AddMemberHandler, "/convo/add", by.tok, &ufo.MemberIn{
+			GroupID: group, Members: members, Role: role,
+		}).Code
+	}
+	remove := func(by user, members ...ufo.FingerPrint) int {
+		t.Helper()
+		return postAuth(t, srv.RemoveMemberHandler, "/convo/remove", by.tok, &ufo.MemberIn{
+			GroupID: group, Members: members,
+		}).Code
+	}
+	role := func(by user, member ufo.FingerPrint, r ufo.Role) int {
+		t.Helper()
+		return postAuth(t, srv.RoleHandler, "/convo/role", by.tok, &ufo.RoleIn{
+			GroupID: group, Member: member, Role: r,
+		}).Code
+	}
+
+	assert.Equal(t, 403, write(c))
+	assert.Equal(t, 200, write(d))
+	assert.Equal(t, 200, postAuth(t, srv.ReadHandler, "/read", c.tok, &ufo.ReadIn{GroupID: group}).Code)
+
+	//Admins
+	assert.Equal(t, 403, add(d, "", e.fp))
+	assert.Equal(t, 403, add(b, ufo.RoleAdmin, e.fp))
+	assert.Equal(t, 403, add(b, ufo.RoleOwner, e.fp))
+	assert.Equal(t, 200, add(b, ufo.RoleReadOnly, e.fp))
+	assert.Equal(t, 403, write(e))
+	assert.Equal(t, 403, remove(b, a.fp))
+	assert.Equal(t, 403, remove(d, e.fp))
+	assert.Equal(t, 200, remove(b, e.fp))
+	assert.Equal(t, 200, role(b, c.fp, ufo.RoleMember))
+	assert.Equal(t, 200, write(c))
+	assert.Equal(t, 403, role(b, c.fp, ufo.RoleAdmin))
+	assert.Equal(t, 403, role(d, c.fp, ufo.RoleReadOnly))
+
+	//Handing over the group
+	assert.Equal(t, 403, role(b, a.fp, ufo.RoleMember))
+	assert.Equal(t, 200, role(a, b.fp, ufo.RoleOwner))
+	assert.Equal(t, 403, remove(a, b.fp))
+	assert.Equal(t, 200, remove(b, a.fp))
+	assert.Equal(t, 200, role(b, d.fp, ufo.RoleAdmin))
+	assert.Equal(t, 200, postAuth(t, srv.LeaveHandler, "/convo/leave", b.tok, &ufo.MemberIn{GroupID: group}).Code)
+	assert.Equal(t, 200, add(d, ufo.RoleAdmin, e.fp))
+
+	t.Run("bad roles", func(t *testing.T) {
+		for _, roles := range []map[ufo.FingerPrint]ufo.Role{
+			{e.fp: ufo.RoleAdmin},
+			{b.fp: ufo.RoleOwner},
+			{b.fp: "king"},
+		} {
+			w := postAuth(t, srv.MakeConvoHandler, "/convo", a.tok, &ufo.GroupIn{
+				Group: ufo.Group{Members: []ufo.FingerPrint{a.fp, b.fp}, Roles: roles},
+			})
+			assert.Equal(t, 403, w.Code)
+		}
+	})
+}
+
+func TestMeta(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	pubB, _, kpB := register(t, srv)
+	fpA, fpB := makeFingerPrint(pubA), makeFingerPrint(pubB)
+	tokA, tokB := startSession(t, srv, pubA, kpA), startSession(t, srv, pubB, kpB)
+
+	w := postAuth(t, srv.MakeConvoHandler, "/convo", tokA, &ufo.GroupIn{
+		Group: ufo.Group{
+			Members:   []ufo.FingerPrint{fpA, fpB},
+			GroupMeta: ufo.GroupMeta{Name: "ufo", Topic: "sightings"},
+		},
+	})
+	require.Equal(t, 200, w.Code)
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+	group := gout.UUID
+
+	list := func(tok string) ufo.Group {
+		t.Helper()
+		w := postAuth(t, srv.ListHandler, "/list", tok, &ufo.ListIn{})
+		require.Equal(t, 200, w.Code)
+		lout := &ufo.ListOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+		require.Equal(t, 1, len(lout.Groups))
+		return lout.Groups[0]
+	}
+	g := list(tokB)
+	assert.Equal(t, group, g.UUID)
+	assert.Equal(t, ufo.GroupMeta{Name: "ufo", Topic: "sightings"}, g.GroupMeta)
+	assert.Equal(t, fpA, g.Owner)
+
+	meta := ufo.GroupMeta{Name: "UFO", Avatar: "blob/1234"}
+	w = postAuth(t, srv.UpdateHandler, "/convo/update", tokB, &ufo.MetaIn{GroupID: group, GroupMeta: meta})
+	assert.Equal(t, 403, w.Code)
+	w = postAuth(t, srv.UpdateHandler, "/convo/update", tokA, &ufo.MetaIn{GroupID: group, GroupMeta: meta})
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, meta, list(tokB).GroupMeta)
+	assert.Equal(t, g.Created, list(tokB).Created)
+
+	//Just over the metadata limit, well under MaxBody
+	big := ufo.GroupMeta{Topic: strings.Repeat("x", 16<<10+1)}
+	w = postAuth(t, srv.UpdateHandler, "/convo/update", tokA, &ufo.MetaIn{GroupID: group, GroupMeta: big})
+	assert.Equal(t, 413, w.Code)
+	assert.Equal(t, meta, list(tokB).GroupMeta)
+	w = postAuth(t, srv.MakeConvoHandler, "/convo", tokA, &ufo.GroupIn{
+		Group: ufo.Group{Members: []ufo.FingerPrint{fpA, fpB}, GroupMeta: big},
+	})
+	assert.Equal(t, 413, w.Code)
+
+	w = postAuth(t, srv.ReadHandler, "/read", tokB, &ufo.ReadIn{GroupID: group})
+	rout := &ufo.ReadOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+	require.Equal(t, 1, len(rout.Msgs))
+	assert.True(t, rout.Msgs[0].System)
+	assert.Equal(t, "updated", rout.Msgs[0].Content)
+}
+
+func TestUnknownMembers(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	pubB, _, _ := register(t, srv)
+	fpA, fpB := makeFingerPrint(pubA), makeFingerPrint(pubB)
+	tokA := startSession(t, srv, pubA, kpA)
+	typo := ufo.FingerPrint(strings.Repeat("0", 64))
+
+	w := postAuth(t, srv.MakeConvoHandler, "/convo", tokA, &ufo.GroupIn{
+		Group: ufo.Group{Members: []ufo.FingerPrint{fpB, typo, "nope"}},
+	})
+	require.Equal(t, 400, w.Code)
+	eout := failure(t, w)
+	assert.Equal(t, "ErrUnknownMember", eout.Code)
+	assert.Equal(t, []ufo.FingerPrint{typo, "nope"}, eout.Unknown)
+
+	//The creator is added and repeats dropped
+	group := makeGroup(t, srv, tokA, fpB, fpB)
+	w = postAuth(t, srv.ListHandler, "/list", tokA, &ufo.ListIn{})
+	lout := &ufo.ListOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	require.Equal(t, 1, len(lout.Groups))
+	assert.Equal(t, group, lout.Groups[0].UUID)
+	assert.Equal(t, []ufo.FingerPrint{fpA, fpB}, lout.Groups[0].Members)
+
+	w = postAuth(t, srv.AddMemberHandler, "/convo/add", tokA, &ufo.MemberIn{
+		GroupID: group, Members: []ufo.FingerPrint{typo},
+	})
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestDM(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	pubB, _, kpB := register(t, srv)
+	pubC, _, _ := register(t, srv)
+	fpA, fpB, fpC := makeFingerPrint(pubA), makeFingerPrint(pubB), makeFingerPrint(pubC)
+	tokA, tokB := startSession(t, srv, pubA, kpA), startSession(t, srv, pubB, kpB)
+
+	dm := func(tok string, fp ufo.FingerPrint) string {
+		t.Helper()
+		w := postAuth(t, srv.DMHandler, "/dm", tok, &ufo.DMIn{Member: fp})
+		require.Equal(t, 200, w.Code)
+		gout := &ufo.GroupOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+		return gout.UUID
+	}
+	group := dm(tokA, fpB)
+	assert.Equal(t, group, dm(tokA, fpB))
+	assert.Equal(t, group, dm(tokB, fpA))
+	assert.NotEqual(t, group, dm(tokA, fpC))
+
+	w := postAuth(t, srv.ListHandler, "/list", tokB, &ufo.ListIn{})
+	lout := &ufo.ListOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	require.Equal(t, 1, len(lout.Groups))
+	assert.Equal(t, group, lout.Groups[0].UUID)
+	assert.True(t, lout.Groups[0].Direct)
+
+	assert.Equal(t, 200, postAuth(t, srv.WriteHandler, "/write", tokB, signWrite(t, kpB, &ufo.WriteIn{GroupID: group, Content: "hi"})).Code)
+	assert.Equal(t, 403, postAuth(t, srv.AddMemberHandler, "/convo/add", tokA, &ufo.MemberIn{
+		GroupID: group, Members: []ufo.FingerPrint{fpC},
+	}).Code)
+	assert.Equal(t, 403, postAuth(t, srv.LeaveHandler, "/convo/leave", tokB, &ufo.MemberIn{GroupID: group}).Code)
+
+	w = postAuth(t, srv.DMHandler, "/dm", tokA, &ufo.DMIn{Member: "nobody"})
+	assert.Equal(t, []ufo.FingerPrint{"nobody"}, failure(t, w).Unknown)
+}
+
+func TestEnvelope(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	pubB, _, kpB := register(t, srv)
+	pubC, _, _ := register(t, srv)
+	fpA, fpB, fpC := makeFingerPrint(pubA), makeFingerPrint(pubB), makeFingerPrint(pubC)
+	tokA, tokB := startSession(t, srv, pubA, kpA), startSession(t, srv, pubB, kpB)
+	group := makeGroup(t, srv, tokA, fpB)
+
+	write := func(e *ufo.Envelope, content string) int {
+		t.Helper()
+		return postAuth(t, srv.WriteHandler, "/write", tokA, signWrite(t, kpA, &ufo.WriteIn{
+			GroupID: group, Content: content, Envelope: e,
+		})).Code
+	}
+	keys := map[ufo.FingerPrint]string{fpA: "a-key", fpB: "b-key"}
+	assert.Equal(t, 400, write(&ufo.Envelope{Ciphertext: "ct", Keys: map[ufo.FingerPrint]string{fpA: "a-key"}}, ""))
+	assert.Equal(t, 400, write(&ufo.Envelope{Ciphertext: "ct", Keys: map[ufo.FingerPrint]string{fpA: "a-key", fpB: "b-key", fpC: "c-key"}}, ""))
+	assert.Equal(t, 400, write(&ufo.Envelope{Keys: keys}, ""))
+	assert.Equal(t, 400, write(&ufo.Envelope{Ciphertext: "ct", Keys: keys}, "plaintext"))
+	assert.Equal(t, 200, write(&ufo.Envelope{Ciphertext: "ct", Keys: keys}, ""))
+
+	for tok, key := range map[string]string{tokA: "a-key", tokB: "b-key"} {
+		w := postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: group})
+		require.Equal(t, 200, w.Code)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		require.Equal(t, 1, len(rout.Msgs))
+		e := rout.Msgs[0].Envelope
+		require.NotNil(t, e)
+		assert.Equal(t, "ct", e.Ciphertext)
+		assert.Equal(t, 1, len(e.Keys))
+		for _, k := range e.Keys {
+			assert.Equal(t, key, k)
+		}
+	}
+}
+
+func TestSenderSig(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	fp := makeFingerPrint(pub)
+	tok := startSession(t, srv, pub, kp)
+	group := makeGroup(t, srv, tok, fp)
+	_, _, other := genKeyPartsRSA(t)
+
+	write := func(in *ufo.WriteIn) int {
+		t.Helper()
+		return postAuth(t, srv.WriteHandler, "/write", tok, in).Code
+	}
+	assert.Equal(t, 400, write(&ufo.WriteIn{GroupID: group, Content: "unsigned"}))
+	w := postAuth(t, srv.WriteHandler, "/write", tok, signWrite(t, other, &ufo.WriteIn{GroupID: group, Content: "forged"}))
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, "ErrBadSig", failure(t, w).Code)
+	in := signWrite(t, kp, &ufo.WriteIn{GroupID: group, Content: "signed"})
+	tampered := *in
+	tampered.Content = "tampered"
+	assert.Equal(t, 400, write(&tampered))
+	assert.Equal(t, 200, write(in))
+	assert.Equal(t, 409, write(in))
+
+	w = postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: group})
+	rout := &ufo.ReadOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+	require.Equal(t, 1, len(rout.Msgs))
+	m := rout.Msgs[0]
+	assert.Equal(t, in.Nonce, m.Nonce)
+	key, err := ufo.ParsePublicKey(pub)
+	require.Nil(t, err)
+	sig, err := base64.StdEncoding.DecodeString(string(m.Sig))
+	require.Nil(t, err)
+	assert.Nil(t, key.Verify(m.Payload(group), sig))
+}
+
+func TestKeyLookup(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	pubB, _, _ := register(t, srv)
+	fpB := makeFingerPrint(pubB)
+	tokA := startSession(t, srv, pubA, kpA)
+	group := makeGroup(t, srv, tokA, fpB)
+
+	w := post(t, srv.KeyHandler, "/key", &ufo.KeyIn{fpB})
+	require.Equal(t, 200, w.Code)
+	kout := &ufo.KeyOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), kout))
+	assert.Equal(t, fpB, kout.FingerPrint)
+	assert.Equal(t, pubB, kout.Public)
+	assert.Equal(t, makeFingerPrint(kout.Public), fpB)
+	assert.Equal(t, ufo.AlgRSA, kout.Alg)
+
+	w = post(t, srv.KeyHandler, "/key", &ufo.KeyIn{ufo.FingerPrint(strings.Repeat("0", 64))})
+	assert.Equal(t, 404, w.Code)
+
+	w = postAuth(t, srv.KeysHandler, "/keys", tokA, &ufo.KeysIn{GroupID: group})
+	require.Equal(t, 200, w.Code)
+	ksout := &ufo.KeysOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), ksout))
+	require.Equal(t, 2, len(ksout.Keys))
+	assert.Equal(t, pubA, ksout.Keys[0].Public)
+	assert.Equal(t, pubB, ksout.Keys[1].Public)
+
+	pubC, _, kpC := register(t, srv)
+	w = postAuth(t, srv.KeysHandler, "/keys", startSession(t, srv, pubC, kpC), &ufo.KeysIn{GroupID: group})
+	assert.Equal(t, 403, w.Code)
+}
+
+func TestRotate(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	pubB, _, kpB := register(t, srv)
+	fpA, fpB := makeFingerPrint(pubA), makeFingerPrint(pubB)
+	tokA, tokB := startSession(t, srv, pubA, kpA), startSession(t, srv, pubB, kpB)
+	group := makeGroup(t, srv, tokA, fpB)
+	w := postAuth(t, srv.DMHandler, "/dm", tokA, &ufo.DMIn{Member: fpB})
+	dm := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), dm))
+
+	w = postAuth(t, srv.WriteHandler, "/write", tokA, signWrite(t, kpA, &ufo.WriteIn{
+		GroupID:  group,
+		Envelope: &ufo.Envelope{Ciphertext: "ct", Keys: map[ufo.FingerPrint]string{fpA: "a-key", fpB: "b-key"}},
+	}))
+	require.Equal(t, 200, w.Code)
+	ack(t, srv, tokA, group, 1)
+
+	pubN, sigN, kpN := genKeyPartsRSA(t)
+	fpN := makeFingerPrint(pubN)
+	w = postAuth(t, srv.RotateHandler, "/rotate", tokA, &ufo.RotateIn{
+		New:        ufo.RegisterIn{Public: pubN, Sig: ufo.Sig(sigN)},
+		Succession: signAny(t, kpA, ufo.SuccessionPayload(fpA, fpB)),
+	})
+	assert.Equal(t, 400, w.Code)
+	w = postAuth(t, srv.RotateHandler, "/rotate", tokA, &ufo.RotateIn{
+		New:        ufo.RegisterIn{Public: pubN, Sig: ufo.Sig(sigN)},
+		Succession: signAny(t, kpA, ufo.SuccessionPayload(fpA, fpN)),
+	})
+	require.Equal(t, 200, w.Code)
+	succ := &ufo.Succession{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), succ))
+	assert.Equal(t, fpA, succ.Old)
+	assert.Equal(t, fpN, succ.New)
+
+	//The old key is finished with
+	assert.Equal(t, 401, postAuth(t, srv.ListHandler, "/list", tokA, &ufo.ListIn{}).Code)
+	assert.Equal(t, 401, post(t, srv.ListHandler, "/list", &ufo.ListIn{sign(t, srv, pubA, kpA)}).Code)
+
+	tokN := startSession(t, srv, pubN, kpN)
+	w = postAuth(t, srv.ListHandler, "/list", tokN, &ufo.ListIn{})
+	lout := &ufo.ListOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	require.Equal(t, 2, len(lout.Groups))
+	for _, g := range lout.Groups {
+		assert.Equal(t, fpN, g.Owner)
+		assert.Equal(t, []ufo.FingerPrint{fpN, fpB}, g.Members)
+	}
+
+	read := func(tok string, in *ufo.ReadIn) []ufo.Msg {
+		t.Helper()
+		in.GroupID = group
+		w := postAuth(t, srv.ReadHandler, "/read", tok, in)
+		require.Equal(t, 200, w.Code)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		return rout.Msgs
+	}
+	msgs := read(tokN, &ufo.ReadIn{})
+	require.Equal(t, 1, len(msgs))
+	assert.True(t, msgs[0].System)
+	assert.Equal(t, fpN, msgs[0].From)
+	msgs = read(tokN, &ufo.ReadIn{Limit: 1, After: new(uint64)})
+	require.Equal(t, 1, len(msgs))
+	assert.Equal(t, map[ufo.FingerPrint]string{fpN: "a-key"}, msgs[0].Envelope.Keys)
+	assert.Equal(t, map[ufo.FingerPrint]string{fpB: "b-key"}, read(tokB, &ufo.ReadIn{Limit: 1})[0].Envelope.Keys)
+
+	w = postAuth(t, srv.DMHandler, "/dm", tokN, &ufo.DMIn{Member: fpB})
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+	assert.Equal(t, dm.UUID, gout.UUID)
+
+	//Nobody can add the old key back
+	for _, w := range []*httptest.ResponseRecorder{
+		postAuth(t, srv.MakeConvoHandler, "/convo", tokB, &ufo.GroupIn{Group: ufo.Group{Members: []ufo.FingerPrint{fpA}}}),
+		postAuth(t, srv.AddMemberHandler, "/convo/add", tokN, &ufo.MemberIn{GroupID: group, Members: []ufo.FingerPrint{fpA}}),
+		postAuth(t, srv.DMHandler, "/dm", tokB, &ufo.DMIn{Member: fpA}),
+	} {
+		assert.Equal(t, 400, w.Code)
+		assert.Equal(t, []ufo.FingerPrint{fpA}, failure(t, w).Unknown)
+	}
+
+	//Anyone can follow the chain
+	w = post(t, srv.KeyHandler, "/key", &ufo.KeyIn{fpA})
+	kout := &ufo.KeyOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), kout))
+	require.NotNil(t, kout.SucceededBy)
+	assert.Equal(t, fpN, kout.SucceededBy.New)
+	key, err := ufo.ParsePublicKey(pubA)
+	require.Nil(t, err)
+	sig, err := base64.StdEncoding.DecodeString(string(kout.SucceededBy.Sig))
+	require.Nil(t, err)
+	assert.Nil(t, key.Verify(ufo.SuccessionPayload(fpA, fpN), sig))
+	w = post(t, srv.KeyHandler, "/key", &ufo.KeyIn{fpN})
+	kout = &ufo.KeyOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), kout))
+	require.NotNil(t, kout.Succeeds)
+	assert.Equal(t, fpA, kout.Succeeds.Old)
+}
+
+func TestRevoke(t *testing.T) {
+	pubC, sigC, kpC := genKeyPartsRSA(t)
+	fpC := makeFingerPrint(pubC)
+	srv := ufo.New(ufo.WithAdmins(fpC))
+	defer srv.Close()
+	require.Equal(t, 200, post(t, srv.RegisterInHandler, "/reg", &ufo.RegisterIn{Public: pubC, Sig: ufo.Sig(sigC)}).Code)
+	pubA, sigA, kpA := register(t, srv)
+	pubB, _, kpB := register(t, srv)
+	fpA, fpB := makeFingerPrint(pubA), makeFingerPrint(pubB)
+	tokA, tokB, tokC := startSession(t, srv, pubA, kpA), startSession(t, srv, pubB, kpB), startSession(t, srv, pubC, kpC)
+	group := makeGroup(t, srv, tokA, fpB, fpC)
+	require.Equal(t, 200, postAuth(t, srv.WriteHandler, "/write", tokA, signWrite(t, kpA, &ufo.WriteIn{GroupID: group, Content: "secret"})).Code)
+	require.Equal(t, 200, postAuth(t, srv.WriteHandler, "/write", tokB, signWrite(t, kpB, &ufo.WriteIn{GroupID: group, Content: "hi"})).Code)
+
+	w := postAuth(t, srv.RevokeHandler, "/revoke", tokA, &ufo.RevokeIn{Sig: signAny(t, kpA, ufo.RevocationPayload(fpB))})
+	assert.Equal(t, 400, w.Code)
+	w = postAuth(t, srv.RevokeHandler, "/revoke", tokA, &ufo.RevokeIn{Sig: signAny(t, kpA, ufo.RevocationPayload(fpA)), Purge: true})
+	require.Equal(t, 200, w.Code)
+
+	assert.Equal(t, 401, postAuth(t, srv.ListHandler, "/list", tokA, &ufo.ListIn{}).Code)
+	reg := func() int {
+		t.Helper()
+		return post(t, srv.RegisterInHandler, "/reg", &ufo.RegisterIn{Public: pubA, Sig: ufo.Sig(sigA)}).Code
+	}
+	assert.Equal(t, 403, reg())
+
+	w = postAuth(t, srv.ListHandler, "/list", tokB, &ufo.ListIn{})
+	lout := &ufo.ListOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	require.Equal(t, 1, len(lout.Groups))
+	assert.Equal(t, fpB, lout.Groups[0].Owner)
+	assert.Equal(t, []ufo.FingerPrint{fpB, fpC}, lout.Groups[0].Members)
+
+	w = postAuth(t, srv.ReadHandler, "/read", tokB, &ufo.ReadIn{GroupID: group})
+	rout := &ufo.ReadOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+	require.Equal(t, 3, len(rout.Msgs))
+	assert.True(t, rout.Msgs[0].Deleted)
+	assert.Empty(t, rout.Msgs[0].Content)
+	assert.Equal(t, "hi", rout.Msgs[1].Content)
+	assert.True(t, rout.Msgs[2].System)
+	assert.Equal(t, fpA, rout.Msgs[2].From)
+
+	//Only admins can let the key back in
+	assert.Equal(t, 403, postAuth(t, srv.ClearHandler, "/revoke/clear", tokB, &ufo.ClearIn{Revoked: fpA}).Code)
+	assert.Equal(t, 200, postAuth(t, srv.ClearHandler, "/revoke/clear", tokC, &ufo.ClearIn{Revoked: fpA}).Code)
+	assert.Equal(t, 200, reg())
+}
+
+func TestStaleSession(t *testing.T) {
+	//Keys are rotated and revoked behind the back of the
+	//first server, which never drops their sessions
+	st := ufo.NewMemStore()
+	srv, other := ufo.New(), ufo.New()
+	defer srv.Close()
+	defer other.Close()
+	require.Nil(t, other.Load(st))
+	pubA, sigA, kpA := register(t, srv)
+	pubB, sigB, kpB := register(t, srv)
+	fpA, fpB := makeFingerPrint(pubA), makeFingerPrint(pubB)
+	for _, in := range []*ufo.RegisterIn{{Public: pubA, Sig: ufo.Sig(sigA)}, {Public: pubB, Sig: ufo.Sig(sigB)}} {
+		require.Equal(t, 200, post(t, other.RegisterInHandler, "/reg", in).Code)
+	}
+	tokA, tokB := startSession(t, srv, pubA, kpA), startSession(t, srv, pubB, kpB)
+
+	pubN, sigN, _ := genKeyPartsRSA(t)
+	w := post(t, other.RotateHandler, "/rotate", &ufo.RotateIn{
+		SignedFingerPrint: sign(t, other, pubA, kpA),
+		New:               ufo.RegisterIn{Public: pubN, Sig: ufo.Sig(sigN)},
+		Succession:        signAny(t, kpA, ufo.SuccessionPayload(fpA, makeFingerPrint(pubN))),
+	})
+	require.Equal(t, 200, w.Code)
+	w = post(t, other.RevokeHandler, "/revoke", &ufo.RevokeIn{
+		SignedFingerPrint: sign(t, other, pubB, kpB),
+		Sig:               signAny(t, kpB, ufo.RevocationPayload(fpB)),
+	})
+	require.Equal(t, 200, w.Code)
+
+	require.Equal(t, 200, postAuth(t, srv.ListHandler, "/list", tokA, &ufo.ListIn{}).Code)
+	require.Nil(t, srv.Load(st))
+	assert.Equal(t, 401, postAuth(t, srv.ListHandler, "/list", tokA, &ufo.ListIn{}).Code)
+	assert.Equal(t, 401, postAuth(t, srv.ListHandler, "/list", tokB, &ufo.ListIn{}).Code)
+}
+
+func TestDevices(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	pubL, _, kpL := register(t, srv)
+	pubB, _, kpB := register(t, srv)
+	fpA, fpL, fpB := makeFingerPrint(pubA), makeFingerPrint(pubL), makeFingerPrint(pubB)
+	tokA, tokL, tokB := startSession(t, srv, pubA, kpA), startSession(t, srv, pubL, kpL), startSession(t, srv, pubB, kpB)
+	w := postAuth(t, srv.MakeConvoHandler, "/convo", tokB, &ufo.GroupIn{
+		Group: ufo.Group{Members: []ufo.FingerPrint{fpB, fpA}, Reciepts: true},
+	})
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+	group := gout.UUID
+
+	link := func(sig ufo.Sig) int {
+		t.Helper()
+		return postAuth(t, srv.LinkHandler, "/link", tokL, &ufo.LinkIn{Approver: fpA, Approval: sig}).Code
+	}
+	assert.Equal(t, 400, link(signAny(t, kpL, ufo.LinkPayload(fpA, fpL))))
+	assert.Equal(t, 200, link(signAny(t, kpA, ufo.LinkPayload(fpA, fpL))))
+	assert.Equal(t, 409, link(signAny(t, kpA, ufo.LinkPayload(fpA, fpL))))
+
+	//The laptop is part of the account, not an account itself
+	w = postAuth(t, srv.ListHandler, "/list", tokL, &ufo.ListIn{})
+	lout := &ufo.ListOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	require.Equal(t, 1, len(lout.Groups))
+	assert.Equal(t, group, lout.Groups[0].UUID)
+	assert.Equal(t, 400, postAuth(t, srv.AddMemberHandler, "/convo/add", tokB, &ufo.MemberIn{
+		GroupID: group, Members: []ufo.FingerPrint{fpL},
+	}).Code)
+
+	w = postAuth(t, srv.KeysHandler, "/keys", tokB, &ufo.KeysIn{GroupID: group})
+	kout := &ufo.KeysOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), kout))
+	require.Equal(t, 3, len(kout.Keys))
+	assert.Equal(t, fpL, kout.Keys[2].FingerPrint)
+	assert.Equal(t, fpA, kout.Keys[2].Account)
+
+	//Every device hears about new messages
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	var streams []*bufio.Reader
+	for _, tok := range []string{tokA, tokL} {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/stream", nil)
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		streams = append(streams, bufio.NewReader(resp.Body))
+	}
+	keys := map[ufo.FingerPrint]string{fpA: "a-key", fpB: "b-key"}
+	assert.Equal(t, 400, postAuth(t, srv.WriteHandler, "/write", tokB, signWrite(t, kpB, &ufo.WriteIn{
+		GroupID: group, Envelope: &ufo.Envelope{Ciphertext: "ct", Keys: keys},
+	})).Code)
+	keys[fpL] = "l-key"
+	require.Equal(t, 200, postAuth(t, srv.WriteHandler, "/write", tokB, signWrite(t, kpB, &ufo.WriteIn{
+		GroupID: group, Envelope: &ufo.Envelope{Ciphertext: "ct", Keys: keys},
+	})).Code)
+	for i, key := range []string{"a-key", "l-key"} {
+		line, err := streams[i].ReadString('\n')
+		require.Nil(t, err)
+		var out ufo.StreamOut
+		require.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &out))
+		assert.Equal(t, fpB, out.From)
+		assert.Equal(t, 1, len(out.Envelope.Keys))
+		for _, k := range out.Envelope.Keys {
+			assert.Equal(t, key, k)
+		}
+	}
+
+	//Devices write as the account and keep their own place
+	require.Equal(t, 200, postAuth(t, srv.WriteHandler, "/write", tokL, signWrite(t, kpL, &ufo.WriteIn{
+		GroupID: group, Envelope: &ufo.Envelope{Ciphertext: "reply", Keys: keys},
+	})).Code)
+	ack(t, srv, tokA, group, 2)
+	read := func(tok string) *ufo.ReadOut {
+		t.Helper()
+		w := postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: group})
+		require.Equal(t, 200, w.Code)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		return rout
+	}
+	assert.Equal(t, 0, len(read(tokA).Msgs))
+	rout := read(tokL)
+	require.Equal(t, 2, len(rout.Msgs))
+	assert.Equal(t, fpA, rout.Msgs[1].From)
+	assert.Equal(t, fpL, rout.Msgs[1].Device)
+	assert.Equal(t, uint64(2), read(tokB).Reciepts[fpA])
+
+	//Losing a device leaves the account where it was
+	w = postAuth(t, srv.RevokeHandler, "/revoke", tokL, &ufo.RevokeIn{Sig: signAny(t, kpL, ufo.RevocationPayload(fpL))})
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, 401, postAuth(t, srv.ListHandler, "/list", tokL, &ufo.ListIn{}).Code)
+	w = postAuth(t, srv.ListHandler, "/list", tokA, &ufo.ListIn{})
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	assert.Equal(t, 1, len(lout.Groups))
+
+	//A key in groups of its own would leave them behind
+	pubC, _, kpC := register(t, srv)
+	fpC := makeFingerPrint(pubC)
+	tokC := startSession(t, srv, pubC, kpC)
+	makeGroup(t, srv, tokB, fpC)
+	w = postAuth(t, srv.LinkHandler, "/link", tokC, &ufo.LinkIn{Approver: fpA, Approval: signAny(t, kpA, ufo.LinkPayload(fpA, fpC))})
+	assert.Equal(t, 403, w.Code)
+	assert.Equal(t, "ErrNotAllowed", failure(t, w).Code)
+}
+
+func TestLinkRace(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pubA, _, kpA := register(t, srv)
+	fpA := makeFingerPrint(pubA)
+	tokA := startSession(t, srv, pubA, kpA)
+	group := makeGroup(t, srv, tokA)
+
+	//A key ends up either linked or in the group, never both
+	for i := 0; i < 5; i++ {
+		pubL, _, kpL := register(t, srv)
+		fpL := makeFingerPrint(pubL)
+		tokL := startSession(t, srv, pubL, kpL)
+		linked, added := make(chan int), make(chan int)
+		go func() {
+			linked <- postAuth(t, srv.LinkHandler, "/link", tokL, &ufo.LinkIn{Approver: fpA, Approval: signAny(t, kpA, ufo.LinkPayload(fpA, fpL))}).Code
+		}()
+		go func() {
+			added <- postAuth(t, srv.AddMemberHandler, "/convo/add", tokA, &ufo.MemberIn{GroupID: group, Members: []ufo.FingerPrint{fpL}}).Code
+		}()
+		l, a := <-linked, <-added
+		assert.True(t, (l == 200) != (a == 200), "link %d, add %d", l, a)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, sig, kp := register(t, srv)
+	tok := startSession(t, srv, pub, kp)
+
+	check := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		assert.Equal(t, status, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		out := failure(t, w)
+		assert.Equal(t, code, out.Code)
+		assert.NotEmpty(t, out.Message)
+	}
+
+	check(post(t, srv.RegisterInHandler, "/reg", &ufo.RegisterIn{Public: pub, Sig: ufo.Sig(sig)}), 409, "ErrKeyExists")
+	check(post(t, srv.ListHandler, "/list", &ufo.ListIn{}), 401, "ErrAuthDenied")
+	//A bad signature from an RSA key is only a failed login
+	sfp := sign(t, srv, pub, kp)
+	sfp.SignedChallenge = signAny(t, kp, []byte("not the challenge"))
+	check(post(t, srv.ListHandler, "/list", &ufo.ListIn{sfp}), 401, "ErrAuthDenied")
+	sfp = sign(t, srv, pub, kp)
+	sfp.SignedChallenge = signAny(t, kp, []byte("not the challenge"))
+	check(post(t, srv.SessionHandler, "/session", &ufo.SessionIn{sfp}), 401, "ErrAuthDenied")
+	check(postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: "nope"}), 400, "ErrBadUUID")
+	check(postAuth(t, srv.ReadHandler, "/read", tok, &ufo.ReadIn{GroupID: uuid.New().String()}), 404, "ErrNoSuchUUID")
+	check(post(t, srv.KeyHandler, "/key", &ufo.KeyIn{"nope"}), 404, "ErrKeyNotExist")
+	check(post(t, srv.ServeHTTP, "/nope", nil), 404, "ErrNoSuchEndpoint")
+
+	req := httptest.NewRequest(http.MethodPost, "/list", strings.NewReader("{"))
+	w := httptest.NewRecorder()
+	srv.ListHandler(w, req)
+	check(w, 400, "ErrBadRequest")
+
+	big := strings.Repeat("a", ufo.MaxBody)
+	check(postAuth(t, srv.WriteHandler, "/write", tok, &ufo.WriteIn{Content: big}), 413, "ErrTooLarge")
+}
+
+func TestServers(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	other := ufo.New()
+	defer other.Close()
+
+	//Each server keeps its own keys
+	pub, _, kp := register(t, srv)
+	startSession(t, srv, pub, kp)
+	w := post(t, other.KeyHandler, "/key", &ufo.KeyIn{makeFingerPrint(pub)})
+	assert.Equal(t, 404, w.Code)
+	register(t, other)
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	resp, err := http.Post(ts.URL+"/key", "application/json", strings.NewReader(`{"FingerPrint":"`+string(makeFingerPrint(pub))+`"}`))
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestShutdown(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, kp := register(t, srv)
+	tok := startSession(t, srv, pub, kp)
+
+	ts := httptest.NewUnstartedServer(srv)
+	ts.Config.RegisterOnShutdown(srv.Drain)
+	ts.Start()
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/stream", nil)
+	require.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+
+	//The open stream does not hold up shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, ts.Config.Shutdown(ctx))
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Nil(t, srv.Close())
+	assert.Nil(t, srv.Close())
+}
+
+func TestGiveUp(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	pub, _, _ := register(t, srv)
+	in := &ufo.KeyIn{makeFingerPrint(pub)}
+
+	//The client went away
+	b, err := json.Marshal(in)
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/key", bytes.NewBuffer(b)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	srv.KeyHandler(w, req)
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "ErrCanceled", failure(t, w).Code)
+
+	//The server took too long
+	slow := ufo.New(ufo.WithTimeout(time.Nanosecond))
+	defer slow.Close()
+	w = post(t, slow.KeyHandler, "/key", in)
+	assert.Equal(t, 504, w.Code)
+	assert.Equal(t, "ErrTimeout", failure(t, w).Code)
+
+	//The server is gone
+	require.Nil(t, srv.Close())
+	w = post(t, srv.KeyHandler, "/key", in)
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "ErrClosed", failure(t, w).Code)
+}
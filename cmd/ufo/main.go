@@ -1,19 +1,73 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/SD-Paranoia/ufo"
 )
 
 func main() {
+	path := flag.String("store", "ufo.db", "path of the on disk store")
+	admins := flag.String("admins", "", "comma separated fingerprints of the server admins")
+	grace := flag.Duration("grace", 30*time.Second, "how long to wait for requests to finish on shut down")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long a request may wait on the server before giving up")
+	flag.Parse()
+
+	var fps []ufo.FingerPrint
+	for _, fp := range strings.Split(*admins, ",") {
+		if fp != "" {
+			fps = append(fps, ufo.FingerPrint(fp))
+		}
+	}
+	srv := ufo.New(ufo.WithAdmins(fps...), ufo.WithTimeout(*timeout))
+
+	store, err := ufo.OpenFileStore(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = srv.Load(store); err != nil {
+		log.Fatal(err)
+	}
+
+	//No WriteTimeout, /stream and waiting reads hold
+	//their responses open for longer than any sane one
 	s := &http.Server{
-		Addr:         ":8080",
-		Handler:      http.HandlerFunc(ufo.UFO),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:        ":8080",
+		Handler:     srv,
+		ReadTimeout: 5 * time.Second,
+		IdleTimeout: 2 * time.Minute,
+	}
+	//Streams never go idle on their own
+	s.RegisterOnShutdown(srv.Drain)
+
+	idle := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		log.Printf("%v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *grace)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+		close(idle)
+	}()
+
+	if err = s.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idle
+	//Only once every request is done, so nothing is half written
+	if err = srv.Close(); err != nil {
+		log.Fatal(err)
 	}
-	log.Fatal(s.ListenAndServe())
-}
\ No newline at end of file
+}
@@ -1,30 +1,157 @@
 package ufo
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"math/big"
 )
 
-//ParsePublicRSA parses a PKIX PEM encoded RSA key
-func ParsePublicRSA(public string) (*rsa.PublicKey, error) {
+//Algorithm is the kind of key a user registered with
+type Algorithm string
+
+//Supported key algorithms
+const (
+	AlgRSA     Algorithm = "RSA"     //PKCS1v15 over SHA256
+	AlgEd25519 Algorithm = "Ed25519" //Ed25519 over the raw message
+	AlgECDSA   Algorithm = "ECDSA"   //P-256 ASN.1 signature over SHA256
+)
+
+//Scheme is the signature scheme an RSA key signs with
+type Scheme string
+
+//Supported RSA signature schemes, both over SHA256
+const (
+	SchemePKCS1v15 Scheme = "PKCS1v15" //The default
+	SchemePSS      Scheme = "PSS"      //Any salt length is accepted
+)
+
+//ErrUnsupportedScheme is returned when a key is registered
+//with a signature scheme it can not be used with
+var ErrUnsupportedScheme = errors.New("Unsupported signature scheme")
+
+//ErrUnsupportedKey is returned when a key is not
+//one of the supported algorithms
+var ErrUnsupportedKey = errors.New("Unsupported key type")
+
+//ErrBadSig is returned when a signature does not verify
+var ErrBadSig = errors.New("Bad signature")
+
+//ErrBadKey is returned when a public key
+//is not a PKIX PEM encoded key
+var ErrBadKey = errors.New("Malformed key")
+
+//PublicKey is a parsed public key of any supported algorithm
+type PublicKey struct {
+	Alg    Algorithm
+	Scheme Scheme //Only set for RSA keys
+	crypto.PublicKey
+	pem string //As it was parsed
+}
+
+//ParsePublicKey parses a PKIX PEM encoded RSA,
+//Ed25519 or P-256 ECDSA key
+func ParsePublicKey(public string) (*PublicKey, error) {
 	block, _ := pem.Decode([]byte(public))
 	if block == nil {
-		return nil, errors.New("failed to parse PEM block containing the key")
+		return nil, fmt.Errorf("%w: no PEM block", ErrBadKey)
 	}
 
 	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrBadKey, err)
 	}
 
 	switch pub := pub.(type) {
 	case *rsa.PublicKey:
-		return pub, nil
+		return &PublicKey{Alg: AlgRSA, Scheme: SchemePKCS1v15, PublicKey: pub, pem: public}, nil
+	case ed25519.PublicKey:
+		return &PublicKey{Alg: AlgEd25519, PublicKey: pub, pem: public}, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, ErrUnsupportedKey
+		}
+		return &PublicKey{Alg: AlgECDSA, PublicKey: pub, pem: public}, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+//SetScheme sets the signature scheme pub is verified
+//with, only RSA keys support more than one scheme.
+func (pub *PublicKey) SetScheme(scheme Scheme) error {
+	switch {
+	case scheme == "":
+		return nil
+	case pub.Alg != AlgRSA:
+		return ErrUnsupportedScheme
+	case scheme != SchemePKCS1v15 && scheme != SchemePSS:
+		return ErrUnsupportedScheme
+	}
+	pub.Scheme = scheme
+	return nil
+}
+
+//Verify checks that sig is a signature of msg made by
+//the private half of pub
+func (pub *PublicKey) Verify(msg, sig []byte) error {
+	hashed := sha256.Sum256(msg)
+	switch key := pub.PublicKey.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if pub.Scheme == SchemePSS {
+			err = rsa.VerifyPSS(key, crypto.SHA256, hashed[:], sig, nil)
+		} else {
+			err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sig)
+		}
+		if err != nil {
+			return ErrBadSig
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, msg, sig) {
+			return ErrBadSig
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(sig, &esig)
+		if err != nil || len(rest) != 0 {
+			return ErrBadSig
+		}
+		if !ecdsa.Verify(key, hashed[:], esig.R, esig.S) {
+			return ErrBadSig
+		}
+		return nil
 	default:
+		return ErrUnsupportedKey
+	}
+}
+
+//ParsePublicRSA parses a PKIX PEM encoded RSA key
+func ParsePublicRSA(public string) (*rsa.PublicKey, error) {
+	pub, err := ParsePublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	rpub, ok := pub.PublicKey.(*rsa.PublicKey)
+	if !ok {
 		return nil, errors.New("Key type is not RSA")
 	}
+	return rpub, nil
 }
 
 //EncodePublicRSA key takes a PublicKey struct and
@@ -43,3 +170,81 @@ func EncodePublicRSA(pubkey *rsa.PublicKey) (string, error) {
 
 	return string(pubkeyPem), nil
 }
+
+//EncodePublicKey takes an RSA, Ed25519 or ECDSA public
+//key and encodes it to a PKIX PEM encoded string
+func EncodePublicKey(pubkey crypto.PublicKey) (string, error) {
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		return "", err
+	}
+	pubkeyPem := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pubkeyBytes,
+		},
+	)
+
+	return string(pubkeyPem), nil
+}
+
+//SuccessionPayload is what the old key signs
+//when rotating from old to new
+func SuccessionPayload(old, new FingerPrint) []byte {
+	b, _ := json.Marshal([]string{"succession", string(old), string(new)})
+	return b
+}
+
+//LinkPayload is what an existing device of account
+//signs to approve linking device to it
+func LinkPayload(account, device FingerPrint) []byte {
+	b, _ := json.Marshal([]string{"link", string(account), string(device)})
+	return b
+}
+
+//RevocationPayload is what a key signs to revoke itself
+func RevocationPayload(fp FingerPrint) []byte {
+	b, _ := json.Marshal([]string{"revocation", string(fp)})
+	return b
+}
+
+//decodeSig decodes the base64 signature sig
+func decodeSig(sig Sig) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(string(sig))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSig, err)
+	}
+	return b, nil
+}
+
+//fingerprint is the FingerPrint of a PEM encoded key
+func fingerprint(public string) FingerPrint {
+	hashed := sha256.Sum256([]byte(public))
+	return FingerPrint(hex.EncodeToString(hashed[:]))
+}
+
+//Payload is what the sender of a message signs, the group
+//ID, the nonce and either the content or the ciphertext of
+//the envelope.
+func Payload(group, nonce, content string) []byte {
+	b, _ := json.Marshal([]string{group, nonce, content})
+	return b
+}
+
+//Payload is what the sender of m signed
+//when writing it to group
+func (m *Msg) Payload(group string) []byte {
+	content := m.Content
+	if m.Envelope != nil {
+		content = m.Envelope.Ciphertext
+	}
+	return Payload(group, m.Nonce, content)
+}
+
+func (in *WriteIn) payload() []byte {
+	content := in.Content
+	if in.Envelope != nil {
+		content = in.Envelope.Ciphertext
+	}
+	return Payload(in.GroupID, in.Nonce, content)
+}
@@ -2,26 +2,54 @@ package ufo
 
 import (
 	"net/http"
+	"sync"
 )
 
 //map of request to handler translations, not to be modified during run time
-var reqtrans = map[string]http.HandlerFunc{
-	"/reg":   RegisterInHandler,
-	"/chal":  ChallengeHandler,
-	"/convo": MakeConvoHandler,
-	"/read":  ReadHandler,
-	"/write": WriteHandler,
-	"/list":  ListHandler,
-	"/log":   LogHandler,
+var reqtrans = map[string]func(*Server, http.ResponseWriter, *http.Request){
+	"/reg":          (*Server).RegisterInHandler,
+	"/chal":         (*Server).ChallengeHandler,
+	"/session":      (*Server).SessionHandler,
+	"/logout":       (*Server).LogoutHandler,
+	"/convo":        (*Server).MakeConvoHandler,
+	"/convo/add":    (*Server).AddMemberHandler,
+	"/convo/remove": (*Server).RemoveMemberHandler,
+	"/convo/leave":  (*Server).LeaveHandler,
+	"/convo/role":   (*Server).RoleHandler,
+	"/convo/update": (*Server).UpdateHandler,
+	"/dm":           (*Server).DMHandler,
+	"/key":          (*Server).KeyHandler,
+	"/keys":         (*Server).KeysHandler,
+	"/rotate":       (*Server).RotateHandler,
+	"/link":         (*Server).LinkHandler,
+	"/revoke":       (*Server).RevokeHandler,
+	"/revoke/clear": (*Server).ClearHandler,
+	"/read":         (*Server).ReadHandler,
+	"/write":        (*Server).WriteHandler,
+	"/ack":          (*Server).AckHandler,
+	"/list":         (*Server).ListHandler,
+	"/stream":       (*Server).StreamHandler,
+	"/log":          (*Server).LogHandler,
 }
 
-//UFO is a http.HandlerFunc that routes all of
-//ufo's HTTP endpoints.
-func UFO(w http.ResponseWriter, r *http.Request) {
+//ServeHTTP routes r to the endpoint for its path
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h, ok := reqtrans[r.URL.Path]; ok {
-		login <- Event{"Request" + r.URL.Path, nil}
-		h(w, r)
+		s.log(Event{"Request" + r.URL.Path, nil})
+		h(s, w, r)
 		return
 	}
-	http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	s.fail(w, "Request"+r.URL.Path, ErrNoSuchEndpoint)
+}
+
+var std struct {
+	once sync.Once
+	*Server
+}
+
+//UFO is a http.HandlerFunc that routes all of ufo's
+//HTTP endpoints to a default, in memory, Server.
+func UFO(w http.ResponseWriter, r *http.Request) {
+	std.once.Do(func() { std.Server = New() })
+	std.ServeHTTP(w, r)
 }
@@ -1,13 +1,17 @@
 package ufo
 
 import (
-	"crypto"
-	"crypto/rsa"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -33,189 +37,1711 @@ var ErrGroupExists = errors.New("Group Exists")
 //sends a malfromed UUID to the server.
 var ErrBadUUID = errors.New("bad UUID")
 
+//ErrNoSuchUUID is returned when a user refers
+//to a group that does not exist.
 var ErrNoSuchUUID = errors.New("No such UUID")
 
+//ErrNotMember is returned when a user tries to read
+//or write a group they are not a member of.
+var ErrNotMember = errors.New("Not a member of group")
+
+//ErrNotAllowed is returned when a user tries to
+//change a group in a way they are not allowed to.
+var ErrNotAllowed = errors.New("Not allowed")
+
+//ErrExpired is returned when a user answers a challenge,
+//or uses a session token, that has expired
+var ErrExpired = errors.New("Challenge or session expired")
+
+//ErrKeyRotated is returned when a key that has
+//been handed on to a new key is used
+var ErrKeyRotated = errors.New("Key has been rotated")
+
+//ErrKeyRevoked is returned when a revoked
+//key tries to register again
+var ErrKeyRevoked = errors.New("Key has been revoked")
+
+//ErrLinked is returned when linking a device
+//that is already linked to an account
+var ErrLinked = errors.New("Device already linked")
+
+//ErrUnknownMember is returned when a group is
+//given members that have not registered a key
+var ErrUnknownMember = errors.New("Unknown members")
+
+//ErrNonceUsed is returned when a user reuses
+//the nonce of a message they already sent
+var ErrNonceUsed = errors.New("Nonce already used")
+
+//ErrBadEnvelope is returned when an Envelope does not
+//have a wrapped key for exactly the members of its group
+var ErrBadEnvelope = errors.New("Bad envelope")
+
+//ErrTooLarge is returned when something a
+//user sends is larger than the server allows.
+var ErrTooLarge = errors.New("Too large")
+
+//ErrClosed is returned when a request
+//reaches a Server that has been closed
+var ErrClosed = errors.New("Server closed")
+
+//ErrNoSuchMsg is returned when a user acknowledges
+//a message that has not been written yet.
+var ErrNoSuchMsg = errors.New("No such message")
+
+//Buckets that each processor keeps its state in
+const (
+	keysBucket       = "keys"
+	groupsBucket     = "groups"
+	msgsBucket       = "msgs"
+	recieptsBucket   = "reciepts"
+	successionBucket = "succession"
+	revokedBucket    = "revoked"
+	devicesBucket    = "devices"
+)
+
+//load hands a processor a new Store, the processor
+//replaces its state with what is in the Store and
+//reports back on err.
+type load struct {
+	Store
+	err chan error
+}
+
+//envelope carries a request in to a processor along with the
+//context of whoever made it. Replies go on out, which has room
+//for one, so a processor never waits on a caller that gave up.
+//Requests that expect no reply have no out.
+type envelope struct {
+	ctx context.Context
+	in  interface{}
+	out chan interface{}
+}
+
+//gone reports whether the caller has given up
+//on env, processors skip those requests.
+func (env envelope) gone() bool {
+	return env.ctx.Err() != nil
+}
+
+//send passes in to the processor on c and returns its reply,
+//giving up with ctx's error if ctx is done first or ErrClosed
+//if quit is.
+func send(ctx context.Context, quit <-chan struct{}, c chan envelope, in interface{}) (interface{}, error) {
+	env := envelope{ctx, in, make(chan interface{}, 1)}
+	select {
+	case c <- env:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-quit:
+		return nil, ErrClosed
+	}
+	select {
+	case out := <-env.out:
+		return out, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-quit:
+		return nil, ErrClosed
+	}
+}
+
+//proof asks for Data to be checked against
+//the signature and key in SignedFingerPrint
 type proof struct {
 	SignedFingerPrint
-	UUID string
+	Data string
+}
+
+//keyRecord is how a registered key is persisted
+type keyRecord struct {
+	Public string
+	Alg    Algorithm
+	Scheme Scheme `json:",omitempty"`
 }
 
-func registerProc(rin chan RegisterIn, vin chan proof) (chan error, chan error) {
-	keys := make(map[FingerPrint]*rsa.PublicKey)
-	rout := make(chan error)
-	vout := make(chan error)
+func loadKeys(s Store) (map[FingerPrint]*PublicKey, map[FingerPrint]Succession, map[FingerPrint]bool, error) {
+	keys := make(map[FingerPrint]*PublicKey)
+	next := make(map[FingerPrint]Succession)
+	revoked := make(map[FingerPrint]bool)
+	err := s.ForEach(keysBucket, func(k string, v []byte) error {
+		var rec keyRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		pub, err := ParsePublicKey(rec.Public)
+		if err != nil {
+			return err
+		}
+		if err = pub.SetScheme(rec.Scheme); err != nil {
+			return err
+		}
+		keys[FingerPrint(k)] = pub
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = s.ForEach(successionBucket, func(k string, v []byte) error {
+		var succ Succession
+		if err := json.Unmarshal(v, &succ); err != nil {
+			return err
+		}
+		next[FingerPrint(k)] = succ
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	err = s.ForEach(revokedBucket, func(k string, v []byte) error {
+		revoked[FingerPrint(k)] = true
+		return nil
+	})
+	return keys, next, revoked, err
+}
+
+//checkKey parses the key in msg and checks its owner
+//has proven possession of it by signing it.
+func checkKey(msg RegisterIn) (FingerPrint, *PublicKey, error) {
+	pub, err := ParsePublicKey(msg.Public)
+	if err != nil {
+		return "", nil, err
+	}
+	if msg.Alg != "" && msg.Alg != pub.Alg {
+		return "", nil, fmt.Errorf("%w: key is %s not %s", ErrUnsupportedKey, pub.Alg, msg.Alg)
+	}
+	if err = pub.SetScheme(msg.Scheme); err != nil {
+		return "", nil, err
+	}
+	sig, err := decodeSig(msg.Sig)
+	if err != nil {
+		return "", nil, err
+	}
+	if err = pub.Verify([]byte(msg.Public), sig); err != nil {
+		return "", nil, err
+	}
+	return fingerprint(msg.Public), pub, nil
+}
+
+//revocation asks for a key to be revoked, Sig must be its
+//signature of RevocationPayload. If clear is set the key
+//may register again instead.
+type revocation struct {
+	FingerPrint
+	Sig   Sig
+	clear bool
+	force bool //Skip the signature, the key's account is being revoked
+}
+
+//rotation is the result of a RotateIn request
+type rotation struct {
+	Succession
+	err error
+}
+
+func registerProc(ctx context.Context, wg *sync.WaitGroup, s Store, rin, vin, kin, sin, xin chan envelope, lin chan load) {
+	keys := make(map[FingerPrint]*PublicKey)
+	next := make(map[FingerPrint]Succession)
+	prev := make(map[FingerPrint]Succession)
+	revoked := make(map[FingerPrint]bool)
+	//add commits a key once its owner has proven possession
+	add := func(msg RegisterIn) (FingerPrint, *PublicKey, error) {
+		fp, pub, err := checkKey(msg)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, ok := keys[fp]; ok {
+			return "", nil, ErrKeyExists
+		}
+		if revoked[fp] {
+			return "", nil, ErrKeyRevoked
+		}
+		b, _ := json.Marshal(&keyRecord{msg.Public, pub.Alg, pub.Scheme})
+		if err = s.Put(keysBucket, string(fp), b); err != nil {
+			return "", nil, err
+		}
+		keys[fp] = pub
+		return fp, pub, nil
+	}
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
-			case msg := <-rin:
-				pub, err := ParsePublicRSA(msg.Public)
-				if err != nil {
-					rout <- err
+			case <-ctx.Done():
+				return
+			case l := <-lin:
+				k, n, r, err := loadKeys(l.Store)
+				if err == nil {
+					s, keys, next, revoked = l.Store, k, n, r
+					prev = make(map[FingerPrint]Succession)
+					for _, succ := range next {
+						prev[succ.New] = succ
+					}
+				}
+				l.err <- err
+			case env := <-rin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(RegisterIn)
+				_, _, err := add(msg)
+				env.out <- err
+			case env := <-vin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(proof)
+				pub, ok := keys[msg.SignedFingerPrint.FingerPrint]
+				if !ok {
+					env.out <- ErrKeyNotExist
 					continue
 				}
-				hashed := sha256.Sum256([]byte(msg.Public))
-				fp := FingerPrint(hex.EncodeToString(hashed[:]))
-				if _, ok := keys[fp]; ok {
-					rout <- ErrKeyExists
+				if _, ok = next[msg.SignedFingerPrint.FingerPrint]; ok {
+					env.out <- ErrKeyRotated
 					continue
 				}
-				keys[fp] = pub
-				sig, err := base64.StdEncoding.DecodeString(string(msg.Sig))
+				sig, err := decodeSig(msg.SignedChallenge)
 				if err != nil {
-					rout <- err
+					env.out <- err
 					continue
 				}
-
-				rout <- rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig)
-			case msg := <-vin:
-				pub, ok := keys[msg.SignedFingerPrint.FingerPrint]
+				env.out <- pub.Verify([]byte(msg.Data), sig)
+			case env := <-kin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.([]FingerPrint)
+				//Reply with those that have a key
+				found := []KeyOut{}
+				for _, fp := range msg {
+					if pub, ok := keys[fp]; ok {
+						k := KeyOut{FingerPrint: fp, Public: pub.pem, Alg: pub.Alg, Scheme: pub.Scheme}
+						if succ, ok := prev[fp]; ok {
+							k.Succeeds = &succ
+						}
+						if succ, ok := next[fp]; ok {
+							k.SucceededBy = &succ
+						}
+						found = append(found, k)
+					}
+				}
+				env.out <- found
+			case env := <-sin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(RotateIn)
+				old := msg.SignedFingerPrint.FingerPrint
+				oldpub, ok := keys[old]
 				if !ok {
-					vout <- ErrKeyNotExist
+					env.out <- rotation{err: ErrKeyNotExist}
+					continue
+				}
+				//Repeating the same succession lets the moves
+				//after it be finished
+				if succ, ok := next[old]; ok {
+					if succ.New != fingerprint(msg.New.Public) || succ.Sig != msg.Succession {
+						env.out <- rotation{err: ErrKeyRotated}
+						continue
+					}
+					env.out <- rotation{succ, nil}
 					continue
 				}
-				sig, err := base64.StdEncoding.DecodeString(string(msg.SignedChallenge))
+				//The old key must name the new one
+				succ := Succession{old, fingerprint(msg.New.Public), msg.Succession, time.Now().UTC()}
+				sig, err := decodeSig(msg.Succession)
 				if err != nil {
-					vout <- err
+					env.out <- rotation{err: err}
+					continue
+				}
+				if err = oldpub.Verify(SuccessionPayload(succ.Old, succ.New), sig); err != nil {
+					env.out <- rotation{err: err}
+					continue
+				}
+				if _, _, err = add(msg.New); err != nil {
+					env.out <- rotation{err: err}
+					continue
+				}
+				b, _ := json.Marshal(&succ)
+				if err = s.Put(successionBucket, string(old), b); err != nil {
+					env.out <- rotation{err: err}
+					continue
+				}
+				next[old], prev[succ.New] = succ, succ
+				env.out <- rotation{succ, nil}
+			case env := <-xin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(revocation)
+				if msg.clear {
+					delete(revoked, msg.FingerPrint)
+					env.out <- s.Delete(revokedBucket, string(msg.FingerPrint))
+					continue
+				}
+				pub, ok := keys[msg.FingerPrint]
+				if !ok {
+					env.out <- ErrKeyNotExist
 					continue
 				}
-				hashed := sha256.Sum256([]byte(msg.UUID))
-				vout <- rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig)
+				if !msg.force {
+					sig, err := decodeSig(msg.Sig)
+					if err != nil {
+						env.out <- err
+						continue
+					}
+					if err = pub.Verify(RevocationPayload(msg.FingerPrint), sig); err != nil {
+						env.out <- err
+						continue
+					}
+				}
+				if err := s.Put(revokedBucket, string(msg.FingerPrint), nil); err != nil {
+					env.out <- err
+					continue
+				}
+				revoked[msg.FingerPrint] = true
+				delete(keys, msg.FingerPrint)
+				env.out <- s.Delete(keysBucket, string(msg.FingerPrint))
 			}
 		}
 	}()
-	return rout, vout
 }
 
+//maxChallenges is how many unanswered challenges
+//a single key may have outstanding at once.
+const maxChallenges = 16
+
 type token struct {
-	UUID string
-	time.Time
+	UUID    string
+	Expires time.Time
+}
+
+//live drops the expired tokens from toks
+func live(toks []token, now time.Time) []token {
+	out := toks[:0]
+	for _, tok := range toks {
+		if now.Before(tok.Expires) {
+			out = append(out, tok)
+		}
+	}
+	return out
 }
 
-func challengeProc(cin chan ChallengeIn, vin chan SignedFingerPrint) (chan ChallengeOut, chan error) {
-	rec := make(map[FingerPrint]*token)
-	cout := make(chan ChallengeOut)
-	vout := make(chan error)
+func challengeProc(ctx context.Context, wg *sync.WaitGroup, ttl time.Duration, cin, vin, dropin, pin chan envelope) {
+	rec := make(map[FingerPrint][]token)
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
-			case msg := <-cin:
-				u, err := uuid.NewUUID()
+			case <-ctx.Done():
+				return
+			case env := <-cin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(ChallengeIn)
+				u, err := uuid.NewRandom()
 				if err != nil {
-					cout <- ChallengeOut{""}
+					env.out <- ChallengeOut{}
+					continue
+				}
+				now := time.Now()
+				for fp, toks := range rec {
+					if toks = live(toks, now); len(toks) == 0 {
+						delete(rec, fp)
+					} else {
+						rec[fp] = toks
+					}
+				}
+				toks := rec[msg.FingerPrint]
+				if len(toks) >= maxChallenges {
+					toks = toks[1:]
+				}
+				tok := token{u.String(), now.Add(ttl)}
+				rec[msg.FingerPrint] = append(toks, tok)
+				env.out <- ChallengeOut{tok.UUID, tok.Expires}
+			case env := <-vin:
+				if env.gone() {
 					continue
 				}
-				us := u.String()
-				tok := &token{us, time.Now()}
-				rec[msg.FingerPrint] = tok
-				cout <- ChallengeOut{us}
-			case msg := <-vin:
-				tok, ok := rec[msg.FingerPrint]
+				msg := env.in.(SignedFingerPrint)
+				now := time.Now()
+				err := ErrAuthDenied
+				for _, tok := range rec[msg.FingerPrint] {
+					if !now.Before(tok.Expires) && (msg.Challenge == "" || msg.Challenge == tok.UUID) {
+						err = ErrExpired
+					}
+				}
+				toks := live(rec[msg.FingerPrint], now)
+				rec[msg.FingerPrint] = toks
+				for i, tok := range toks {
+					if msg.Challenge != "" && msg.Challenge != tok.UUID {
+						continue
+					}
+					out, serr := send(env.ctx, ctx.Done(), pin, proof{msg, tok.UUID})
+					if serr != nil {
+						err = serr
+						break
+					}
+					if err, _ = out.(error); err == nil {
+						//Challenges are single use
+						rec[msg.FingerPrint] = append(toks[:i], toks[i+1:]...)
+						break
+					}
+				}
+				if len(rec[msg.FingerPrint]) == 0 {
+					delete(rec, msg.FingerPrint)
+				}
+				env.out <- err
+			case env := <-dropin:
+				fp := env.in.(FingerPrint)
+				delete(rec, fp)
+			}
+		}
+	}()
+}
+
+type session struct {
+	FingerPrint
+	Expires time.Time
+}
+
+//sessionCheck is the result of looking up a session token
+type sessionCheck struct {
+	FingerPrint
+	err error
+}
+
+func sessionProc(ctx context.Context, wg *sync.WaitGroup, ttl time.Duration, newin, checkin, endin, dropin chan envelope) {
+	sessions := make(map[string]session)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case env := <-newin:
+				if env.gone() {
+					continue
+				}
+				fp := env.in.(FingerPrint)
+				b := make([]byte, 32)
+				if _, err := rand.Read(b); err != nil {
+					env.out <- SessionOut{}
+					continue
+				}
+				now := time.Now()
+				for tok, sess := range sessions {
+					if now.After(sess.Expires) {
+						delete(sessions, tok)
+					}
+				}
+				tok := hex.EncodeToString(b)
+				sess := session{fp, now.Add(ttl)}
+				sessions[tok] = sess
+				env.out <- SessionOut{tok, sess.Expires}
+			case env := <-checkin:
+				if env.gone() {
+					continue
+				}
+				tok := env.in.(string)
+				sess, ok := sessions[tok]
 				if !ok {
-					vout <- ErrAuthDenied
+					env.out <- sessionCheck{err: ErrAuthDenied}
+					continue
+				}
+				if time.Now().After(sess.Expires) {
+					delete(sessions, tok)
+					env.out <- sessionCheck{err: ErrExpired}
 					continue
 				}
-				if time.Now().After(tok.Add(time.Hour)) {
-					vout <- ErrAuthDenied
+				env.out <- sessionCheck{sess.FingerPrint, nil}
+			case env := <-endin:
+				if env.gone() {
 					continue
 				}
-				proofin <- proof{msg, tok.UUID}
-				vout <- <-proofout
+				tok := env.in.(string)
+				if _, ok := sessions[tok]; !ok {
+					env.out <- ErrAuthDenied
+					continue
+				}
+				delete(sessions, tok)
+				env.out <- nil
+			case env := <-dropin:
+				fp := env.in.(FingerPrint)
+				//Every session of a key that can no longer be used
+				for tok, sess := range sessions {
+					if sess.FingerPrint == fp {
+						delete(sessions, tok)
+					}
+				}
 			}
 		}
 	}()
-	return cout, vout
 }
 
-func msgProc(rin chan ReadIn, win chan WriteIn) (chan ReadOut, chan error) {
+//msgKey is the store key of the i'th message in group
+func msgKey(group uuid.UUID, i int) string {
+	return fmt.Sprintf("%s/%016x", group, i)
+}
+
+func recieptKey(r Reciept) string {
+	return string(r.User) + "/" + r.Room
+}
+
+func loadMsgs(s Store) (map[uuid.UUID][]Msg, map[Reciept]int, error) {
 	msgs := make(map[uuid.UUID][]Msg)
 	roll := make(map[Reciept]int)
-	rout := make(chan ReadOut)
-	wout := make(chan error)
+	err := s.ForEach(msgsBucket, func(k string, v []byte) error {
+		g, _ := keysplit(k)
+		u, err := uuid.Parse(g)
+		if err != nil {
+			return err
+		}
+		var m Msg
+		if err = json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		m.ID = uint64(len(msgs[u]) + 1)
+		msgs[u] = append(msgs[u], m)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.ForEach(recieptsBucket, func(k string, v []byte) error {
+		user, room := keysplit(k)
+		i, err := strconv.Atoi(string(v))
+		if err != nil {
+			return err
+		}
+		roll[Reciept{FingerPrint(user), room}] = i
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return msgs, roll, nil
+}
+
+//page returns the messages with IDs between after and
+//before, exclusive. If there are more than limit it returns
+//the oldest of them, or the newest when only before is set.
+func page(msgs []Msg, after, before *uint64, limit int) []Msg {
+	//A message's ID is its index plus one
+	lo, hi := 0, len(msgs)
+	if after != nil && *after < uint64(hi) {
+		lo = int(*after)
+	} else if after != nil {
+		lo = hi
+	}
+	if before != nil && *before <= uint64(hi) {
+		hi = int(*before) - 1
+	}
+	if hi <= lo {
+		return []Msg{}
+	}
+	if limit > 0 && hi-lo > limit {
+		if after == nil {
+			lo = hi - limit
+		} else {
+			hi = lo + limit
+		}
+	}
+	return msgs[lo:hi]
+}
+
+//written is the result of a write, Msg is
+//the message as it was stored.
+type written struct {
+	Msg
+	err error
+}
+
+//fetched is the result of a read
+type fetched struct {
+	ReadOut
+	err error
+}
+
+//readReq is a ReadIn along with the members whose
+//reciepts should be shared with the reader, if any,
+//and the devices each of them reads with.
+type readReq struct {
+	ReadIn
+	Share map[FingerPrint][]FingerPrint
+}
+
+//writeReq is a WriteIn, System is set
+//for messages written by the server.
+type writeReq struct {
+	WriteIn
+	System bool
+}
+
+func msgProc(ctx context.Context, wg *sync.WaitGroup, s Store, rin, win, ain, mvin, pin chan envelope, lin chan load) {
+	msgs := make(map[uuid.UUID][]Msg)
+	roll := make(map[Reciept]int)
+	nonces := make(map[string]bool)
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
-			case msg := <-rin:
+			case <-ctx.Done():
+				return
+			case l := <-lin:
+				m, r, err := loadMsgs(l.Store)
+				if err == nil {
+					s, msgs, roll, nonces = l.Store, m, r, nonceSet(m)
+				}
+				l.err <- err
+			case env := <-rin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(readReq)
 				uuid, err := uuid.Parse(msg.GroupID)
 				if err != nil {
-					rout <- ReadOut{nil, err}
+					env.out <- fetched{err: fmt.Errorf("%w: %s", ErrBadUUID, msg.GroupID)}
 					continue
 				}
-				var outgoing []Msg
-				if out, ok := msgs[uuid]; ok {
-					outgoing = out
-				} else {
-					rout <- ReadOut{nil, ErrNoSuchUUID}
+				var reciepts map[FingerPrint]uint64
+				if len(msg.Share) != 0 {
+					//A member has read as far as their furthest device
+					reciepts = make(map[FingerPrint]uint64)
+					for fp, devices := range msg.Share {
+						for _, d := range devices {
+							if i := uint64(roll[Reciept{d, msg.GroupID}]); i >= reciepts[fp] {
+								reciepts[fp] = i
+							}
+						}
+					}
+				}
+				//Callers have already checked the group exists
+				outgoing := msgs[uuid]
+				if msg.After != nil || msg.Before != nil {
+					//History reads start where they are told to
+					env.out <- fetched{ReadOut{page(outgoing, msg.After, msg.Before, msg.Limit), reciepts}, nil}
 					continue
 				}
-				recp := Reciept{
-					msg.SignedFingerPrint.FingerPrint,
-					msg.GroupID,
+				//Otherwise start from the last acknowledged message,
+				//the reciept is only moved on by an AckIn
+				index := roll[Reciept{msg.FingerPrint, msg.GroupID}]
+				if index >= len(outgoing) {
+					env.out <- fetched{ReadOut{[]Msg{}, reciepts}, nil}
+					continue
 				}
-				var index int
-				if i, ok := roll[recp]; ok {
-					index = i
-				} else {
-					//User has never done a read
-					index = 0
+				end := len(outgoing)
+				if msg.Limit > 0 && index+msg.Limit < end {
+					end = index + msg.Limit
 				}
-				if index >= len(outgoing) {
-					rout <- ReadOut{[]Msg{}, nil}
+				env.out <- fetched{ReadOut{outgoing[index:end], reciepts}, nil}
+			case env := <-ain:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(AckIn)
+				uuid, err := uuid.Parse(msg.GroupID)
+				if err != nil {
+					env.out <- fmt.Errorf("%w: %s", ErrBadUUID, msg.GroupID)
+					continue
+				}
+				if msg.ID > uint64(len(msgs[uuid])) {
+					env.out <- ErrNoSuchMsg
+					continue
+				}
+				recp := Reciept{msg.FingerPrint, msg.GroupID}
+				if int(msg.ID) <= roll[recp] {
+					//Already acknowledged
+					env.out <- nil
+					continue
+				}
+				err = s.Put(recieptsBucket, recieptKey(recp), []byte(strconv.FormatUint(msg.ID, 10)))
+				if err != nil {
+					env.out <- err
+					continue
+				}
+				roll[recp] = int(msg.ID)
+				env.out <- nil
+			case env := <-win:
+				if env.gone() {
 					continue
 				}
-				roll[recp] = len(outgoing)
-				outgoing = outgoing[index:]
-				rout <- ReadOut{outgoing, nil}
-			case msg := <-win:
+				msg := env.in.(writeReq)
 				uuid, err := uuid.Parse(msg.GroupID)
 				if err != nil {
-					wout <- fmt.Errorf("%w: %s", ErrBadUUID, uuid)
+					env.out <- written{err: fmt.Errorf("%w: %s", ErrBadUUID, msg.GroupID)}
+					continue
+				}
+				//A signed message may only be sent once
+				nonce := nonceKey(uuid, msg.SignedFingerPrint.FingerPrint, msg.Nonce)
+				from := msg.SignedFingerPrint.account()
+				var device FingerPrint
+				if from != msg.SignedFingerPrint.FingerPrint {
+					device = msg.SignedFingerPrint.FingerPrint
+				}
+				if !msg.System && nonces[nonce] {
+					env.out <- written{err: ErrNonceUsed}
 					continue
 				}
 				newmsg := Msg{
-					msg.SignedFingerPrint.FingerPrint,
-					msg.Content,
+					ID:       uint64(len(msgs[uuid]) + 1),
+					Time:     time.Now().UTC(),
+					From:     from,
+					Device:   device,
+					Content:  msg.Content,
+					System:   msg.System,
+					Envelope: msg.Envelope,
+					Nonce:    msg.Nonce,
+					Sig:      msg.Sig,
+				}
+				b, _ := json.Marshal(&newmsg)
+				if err = s.Put(msgsBucket, msgKey(uuid, len(msgs[uuid])), b); err != nil {
+					env.out <- written{err: err}
+					continue
 				}
 				msgs[uuid] = append(msgs[uuid], newmsg)
-				wout <- nil
+				if !msg.System {
+					nonces[nonce] = true
+				}
+				env.out <- written{newmsg, nil}
+			case env := <-mvin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(move)
+				env.out <- moveMsgs(s, msgs, roll, msg)
+			case env := <-pin:
+				if env.gone() {
+					continue
+				}
+				fp := env.in.(FingerPrint)
+				env.out <- purgeMsgs(s, msgs, fp)
 			}
 		}
 	}()
-	return rout, wout
 }
 
-func convoProc(makein chan Group, listin chan ListIn) (chan GroupOut, chan ListOut) {
-	dir := make(map[uuid.UUID][]FingerPrint)
+//account is who sfp acts for, its Account once that
+//has been looked up and the key itself otherwise
+func (sfp *SignedFingerPrint) account() FingerPrint {
+	if sfp.Account != "" {
+		return sfp.Account
+	}
+	return sfp.FingerPrint
+}
+
+//sender is the key m was signed with
+func (m *Msg) sender() FingerPrint {
+	if m.Device != "" {
+		return m.Device
+	}
+	return m.From
+}
+
+//purgeMsgs replaces every message fp wrote with a
+//tombstone, so IDs and cursors stay where they are.
+func purgeMsgs(s Store, msgs map[uuid.UUID][]Msg, fp FingerPrint) error {
+	for u := range msgs {
+		var ms []Msg
+		for i, msg := range msgs[u] {
+			if msg.sender() != fp && msg.From != fp || msg.System || msg.Deleted {
+				continue
+			}
+			if ms == nil {
+				ms = append([]Msg(nil), msgs[u]...)
+			}
+			ms[i] = Msg{ID: msg.ID, Time: msg.Time, From: msg.From, Device: msg.Device, Nonce: msg.Nonce, Deleted: true}
+			b, _ := json.Marshal(&ms[i])
+			if err := s.Put(msgsBucket, msgKey(u, i), b); err != nil {
+				return err
+			}
+		}
+		if ms != nil {
+			msgs[u] = ms
+		}
+	}
+	return nil
+}
+
+//move hands everything of Old's in Groups to New
+type move struct {
+	Old, New FingerPrint
+	Groups   []string
+}
+
+//moveMsgs moves m.Old's read cursors and envelope keys
+//to m.New. Groups are copied rather than changed in
+//place as readers may still hold the old slices.
+func moveMsgs(s Store, msgs map[uuid.UUID][]Msg, roll map[Reciept]int, m move) error {
+	for _, g := range m.Groups {
+		u, err := uuid.Parse(g)
+		if err != nil {
+			return err
+		}
+		ms := append([]Msg(nil), msgs[u]...)
+		for i, msg := range ms {
+			k, ok := msg.Envelope.key(m.Old)
+			if !ok {
+				continue
+			}
+			e := &Envelope{msg.Envelope.Ciphertext, make(map[FingerPrint]string)}
+			for fp, v := range msg.Envelope.Keys {
+				e.Keys[fp] = v
+			}
+			delete(e.Keys, m.Old)
+			if _, ok = e.Keys[m.New]; !ok {
+				e.Keys[m.New] = k
+			}
+			msg.Envelope = e
+			b, _ := json.Marshal(&msg)
+			if err = s.Put(msgsBucket, msgKey(u, i), b); err != nil {
+				return err
+			}
+			ms[i] = msg
+		}
+		msgs[u] = ms
+
+		old, recp := Reciept{m.Old, g}, Reciept{m.New, g}
+		if i, ok := roll[old]; ok && i > roll[recp] {
+			err = s.Put(recieptsBucket, recieptKey(recp), []byte(strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			roll[recp] = i
+		}
+		if err = s.Delete(recieptsBucket, recieptKey(old)); err != nil {
+			return err
+		}
+		delete(roll, old)
+	}
+	return nil
+}
+
+func nonceKey(group uuid.UUID, from FingerPrint, nonce string) string {
+	return group.String() + "/" + string(from) + "/" + nonce
+}
+
+//nonceSet collects the nonces already used in msgs
+func nonceSet(msgs map[uuid.UUID][]Msg) map[string]bool {
+	nonces := make(map[string]bool)
+	for u, ms := range msgs {
+		for _, m := range ms {
+			if !m.System {
+				nonces[nonceKey(u, m.sender(), m.Nonce)] = true
+			}
+		}
+	}
+	return nonces
+}
+
+//check makes sure e can be opened by every one of members
+//and nobody else
+func (e *Envelope) check(members []FingerPrint) error {
+	if e.Ciphertext == "" {
+		return fmt.Errorf("%w: no ciphertext", ErrBadEnvelope)
+	}
+	for _, fp := range members {
+		if e.Keys[fp] == "" {
+			return fmt.Errorf("%w: no key for %s", ErrBadEnvelope, fp)
+		}
+	}
+	if len(e.Keys) != len(members) {
+		return fmt.Errorf("%w: keys for non members", ErrBadEnvelope)
+	}
+	return nil
+}
+
+//key returns the wrapped key for fp, if e has one
+func (e *Envelope) key(fp FingerPrint) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	k, ok := e.Keys[fp]
+	return k, ok
+}
+
+//to returns m as it should be delivered to fp, with
+//only their own key left in the envelope.
+func (m Msg) to(fp FingerPrint) Msg {
+	if m.Envelope == nil {
+		return m
+	}
+	e := &Envelope{Ciphertext: m.Envelope.Ciphertext}
+	if k, ok := m.Envelope.Keys[fp]; ok {
+		e.Keys = map[FingerPrint]string{fp: k}
+	}
+	m.Envelope = e
+	return m
+}
+
+//addressed returns a copy of msgs with every
+//envelope cut down to the key for fp
+func addressed(msgs []Msg, fp FingerPrint) []Msg {
+	out := make([]Msg, len(msgs))
+	for i := range msgs {
+		out[i] = msgs[i].to(fp)
+	}
+	return out
+}
+
+//subscription is a channel that receives every message
+//sent to the groups of a user, or only to GroupID if set.
+type subscription struct {
+	FingerPrint
+	GroupID string
+	ch      chan StreamOut
+}
+
+//publication is a message to hand to
+//the subscriptions of every member.
+type publication struct {
+	Members []FingerPrint
+	StreamOut
+}
+
+func streamProc(ctx context.Context, wg *sync.WaitGroup, subin, unsubin, pubin chan envelope) {
+	subs := make(map[FingerPrint]map[chan StreamOut]string)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case env := <-subin:
+				sub := env.in.(subscription)
+				if subs[sub.FingerPrint] == nil {
+					subs[sub.FingerPrint] = make(map[chan StreamOut]string)
+				}
+				subs[sub.FingerPrint][sub.ch] = sub.GroupID
+			case env := <-unsubin:
+				sub := env.in.(subscription)
+				delete(subs[sub.FingerPrint], sub.ch)
+				if len(subs[sub.FingerPrint]) == 0 {
+					delete(subs, sub.FingerPrint)
+				}
+			case env := <-pubin:
+				pub := env.in.(publication)
+				for _, fp := range pub.Members {
+					for ch, group := range subs[fp] {
+						if group != "" && group != pub.GroupID {
+							continue
+						}
+						select {
+						case ch <- pub.StreamOut:
+						default:
+							//Slow subscribers catch up with a read
+						}
+					}
+				}
+			}
+		}
+	}()
+}
+
+func loadConvos(s Store) (map[uuid.UUID]Group, map[FingerPrint][]uuid.UUID, error) {
+	dir := make(map[uuid.UUID]Group)
+	bdir := make(map[FingerPrint][]uuid.UUID)
+	err := s.ForEach(groupsBucket, func(k string, v []byte) error {
+		u, err := uuid.Parse(k)
+		if err != nil {
+			return err
+		}
+		var g Group
+		if err = json.Unmarshal(v, &g); err != nil {
+			return err
+		}
+		dir[u] = g
+		for _, fp := range g.Members {
+			bdir[fp] = append(bdir[fp], u)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dir, bdir, nil
+}
+
+//Ways a group's members can be changed
+const (
+	opAdd    = "add"
+	opRemove = "remove"
+	opLeave  = "leave"
+	opRole   = "role"
+	opMeta   = "meta"
+	opRevoke = "revoke"
+)
+
+//maxMeta is the most bytes of GroupMeta a group may have
+const maxMeta = 16 << 10
+
+func (m *GroupMeta) size() int {
+	return len(m.Name) + len(m.Topic) + len(m.Avatar)
+}
+
+//change is a request by a user to change the members
+//of a group, Role is given to those added or changed.
+type change struct {
+	Op      string
+	By      FingerPrint
+	GroupID string
+	Members []FingerPrint
+	Role    Role
+	Meta    GroupMeta
+}
+
+//changed is the result of a change, Group is the group
+//after it and Changed who was added, removed or changed.
+type changed struct {
+	Group
+	Changed []FingerPrint
+	err     error
+}
+
+func indexOf(fps []FingerPrint, fp FingerPrint) int {
+	for i := range fps {
+		if fps[i] == fp {
+			return i
+		}
+	}
+	return -1
+}
+
+//dmSpace is the namespace direct conversation IDs are made in
+var dmSpace = uuid.MustParse("5c0b5ab6-2d4b-4b1e-9a3e-2f8f6c1d7e40")
+
+//dmID is the group ID of the direct conversation between members,
+//it is the same whichever order they are given in.
+func dmID(members []FingerPrint) uuid.UUID {
+	fps := make([]string, len(members))
+	for i := range members {
+		fps[i] = string(members[i])
+	}
+	sort.Strings(fps)
+	return uuid.NewSHA1(dmSpace, []byte(strings.Join(fps, "/")))
+}
+
+//valid reports whether fp looks like a hex encoded sha256
+func (fp FingerPrint) valid() bool {
+	if len(fp) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range fp {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+//dedup returns fps without repeats, keeping the first of each
+func dedup(fps []FingerPrint) []FingerPrint {
+	out := make([]FingerPrint, 0, len(fps))
+	for _, fp := range fps {
+		if indexOf(out, fp) < 0 {
+			out = append(out, fp)
+		}
+	}
+	return out
+}
+
+func without(us []uuid.UUID, u uuid.UUID) []uuid.UUID {
+	out := us[:0]
+	for _, v := range us {
+		if v != u {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+//rank orders roles by how much they are allowed to do,
+//unknown roles rank below everything.
+func (r Role) rank() int {
+	switch r {
+	case RoleReadOnly:
+		return 1
+	case RoleMember:
+		return 2
+	case RoleAdmin:
+		return 3
+	case RoleOwner:
+		return 4
+	}
+	return 0
+}
+
+//RoleOf returns the role of fp in g, or
+//an empty Role if fp is not a member.
+func (g *Group) RoleOf(fp FingerPrint) Role {
+	switch {
+	case indexOf(g.Members, fp) < 0:
+		return ""
+	case fp == g.Owner:
+		return RoleOwner
+	case g.Roles[fp] != "":
+		return g.Roles[fp]
+	}
+	return RoleMember
+}
+
+//setRole gives fp role r in roles, members are
+//the default so are not stored.
+func setRole(roles map[FingerPrint]Role, fp FingerPrint, r Role) {
+	if r == RoleMember || r == "" {
+		delete(roles, fp)
+		return
+	}
+	roles[fp] = r
+}
+
+//successor picks the next owner of g, the longest
+//standing admin or failing that member.
+func (g *Group) successor() FingerPrint {
+	var next FingerPrint
+	best := 0
+	for _, fp := range g.Members {
+		if r := g.RoleOf(fp).rank(); r > best {
+			next, best = fp, r
+		}
+	}
+	return next
+}
+
+//moved is the result of a move, the groups that were changed
+type moved struct {
+	Groups []Group
+	err    error
+}
+
+//rename hands everything old has in g to new, if
+//both are members new keeps the higher role
+func (g *Group) rename(old, new FingerPrint) {
+	r := g.RoleOf(old)
+	if r.rank() < g.RoleOf(new).rank() {
+		r = g.RoleOf(new)
+	}
+	members := make([]FingerPrint, 0, len(g.Members))
+	for _, fp := range g.Members {
+		if fp == old {
+			fp = new
+		}
+		if indexOf(members, fp) < 0 {
+			members = append(members, fp)
+		}
+	}
+	roles := make(map[FingerPrint]Role)
+	for fp, r := range g.Roles {
+		roles[fp] = r
+	}
+	delete(roles, old)
+	if r == RoleOwner {
+		g.Owner = new
+		delete(roles, new)
+	} else {
+		setRole(roles, new, r)
+	}
+	g.Members, g.Roles = members, roles
+}
+
+//apply applies c to g, returning who was changed
+func (c *change) apply(g *Group) ([]FingerPrint, error) {
+	by := g.RoleOf(c.By)
+	if by == "" {
+		return nil, ErrNotMember
+	}
+	if g.Direct && c.Op != opMeta && c.Op != opRevoke {
+		return nil, ErrNotAllowed
+	}
+	role := c.Role
+	if role == "" {
+		role = RoleMember
+	}
+	var diff []FingerPrint
+	members := append([]FingerPrint(nil), g.Members...)
+	roles := make(map[FingerPrint]Role)
+	for fp, r := range g.Roles {
+		roles[fp] = r
+	}
+	switch c.Op {
+	case opAdd:
+		//Only the owner may make admins
+		if by.rank() < RoleAdmin.rank() || role.rank() == 0 ||
+			role.rank() >= RoleOwner.rank() ||
+			(role == RoleAdmin && by != RoleOwner) {
+			return nil, ErrNotAllowed
+		}
+		for _, fp := range c.Members {
+			if indexOf(members, fp) < 0 {
+				members = append(members, fp)
+				setRole(roles, fp, role)
+				diff = append(diff, fp)
+			}
+		}
+	case opRemove:
+		//Admins may only remove those below them
+		if by.rank() < RoleAdmin.rank() {
+			return nil, ErrNotAllowed
+		}
+		for _, fp := range c.Members {
+			if r := g.RoleOf(fp); r.rank() >= by.rank() || r == RoleOwner {
+				return nil, ErrNotAllowed
+			}
+		}
+		for _, fp := range c.Members {
+			if i := indexOf(members, fp); i >= 0 {
+				members = append(members[:i], members[i+1:]...)
+				delete(roles, fp)
+				diff = append(diff, fp)
+			}
+		}
+	case opLeave, opRevoke:
+		i := indexOf(members, c.By)
+		members = append(members[:i], members[i+1:]...)
+		delete(roles, c.By)
+		diff = []FingerPrint{c.By}
+	case opRole:
+		if len(c.Members) != 1 || c.Members[0] == c.By || role.rank() == 0 {
+			return nil, ErrNotAllowed
+		}
+		fp := c.Members[0]
+		r := g.RoleOf(fp)
+		if r == "" {
+			return nil, ErrNotAllowed
+		}
+		//Admins may only move users between member and read-only
+		if by != RoleOwner && (by != RoleAdmin ||
+			r.rank() >= RoleAdmin.rank() || role.rank() >= RoleAdmin.rank()) {
+			return nil, ErrNotAllowed
+		}
+		if role == RoleOwner {
+			//Ownership is handed over, the old owner stays on as an admin
+			g.Owner = fp
+			delete(roles, fp)
+			setRole(roles, c.By, RoleAdmin)
+		} else {
+			setRole(roles, fp, role)
+		}
+		diff = []FingerPrint{fp}
+	case opMeta:
+		if by.rank() < RoleAdmin.rank() {
+			return nil, ErrNotAllowed
+		}
+		if c.Meta.size() > maxMeta {
+			return nil, ErrTooLarge
+		}
+		g.GroupMeta = c.Meta
+		diff = []FingerPrint{c.By}
+	default:
+		return nil, ErrNotAllowed
+	}
+	g.Members = members
+	g.Roles = roles
+	if by == RoleOwner && indexOf(members, c.By) < 0 {
+		g.Owner = g.successor()
+	}
+	return diff, nil
+}
+
+//validRoles checks the roles a group was created with
+func (g *Group) validRoles() error {
+	for fp, r := range g.Roles {
+		if indexOf(g.Members, fp) < 0 || r.rank() == 0 || r == RoleOwner {
+			return fmt.Errorf("%w: %s can not be %s", ErrNotAllowed, fp, r)
+		}
+	}
+	return nil
+}
+
+//membership is the result of checking a user is
+//a member of a group, Group is the group they are in.
+type membership struct {
+	Group
+	err error
+}
+
+//made is the result of making a group
+type made struct {
+	GroupOut
+	err error
+}
+
+//convoProc asks accountProc, on devin and acctlinkin, about
+//devices while it holds its groups still, so a key can not
+//be both a member and a linked device.
+func convoProc(ctx context.Context, wg *sync.WaitGroup, s Store, makein, listin, memin, chin, mvin, linkin, devin, acctlinkin chan envelope, lin chan load) {
+	dir := make(map[uuid.UUID]Group)
 	bdir := make(map[FingerPrint][]uuid.UUID)
-	makeout := make(chan GroupOut)
-	listout := make(chan ListOut)
+	//devices returns which of fps are linked devices
+	devices := func(env envelope, fps []FingerPrint) error {
+		out, err := send(env.ctx, ctx.Done(), devin, fps)
+		if err != nil {
+			return err
+		}
+		accounts := out.(map[FingerPrint][]FingerPrint)
+		var bad unknownMembers
+		for _, fp := range fps {
+			if _, ok := accounts[fp]; !ok {
+				bad = append(bad, fp)
+			}
+		}
+		if len(bad) != 0 {
+			return bad
+		}
+		return nil
+	}
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		for {
 			select {
-			case msg := <-makein:
+			case <-ctx.Done():
+				return
+			case l := <-lin:
+				d, b, err := loadConvos(l.Store)
+				if err == nil {
+					s, dir, bdir = l.Store, d, b
+				}
+				l.err <- err
+			case env := <-makein:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(Group)
+				//The creator is always a member
+				msg.Members = dedup(msg.Members)
+				if indexOf(msg.Members, msg.Owner) < 0 {
+					msg.Members = append([]FingerPrint{msg.Owner}, msg.Members...)
+				}
+				if err := devices(env, msg.Members); err != nil {
+					env.out <- made{err: err}
+					continue
+				}
 				uuid := uuid.New()
+				if msg.Direct {
+					uuid = dmID(msg.Members)
+					//Rotated keys keep their old conversations
+					for _, u := range bdir[msg.Owner] {
+						if dir[u].Direct && dmID(dir[u].Members) == uuid {
+							uuid = u
+						}
+					}
+					if _, ok := dir[uuid]; ok {
+						env.out <- made{GroupOut{uuid.String()}, nil}
+						continue
+					}
+				}
 				_, ok := dir[uuid]
 				if ok {
-					makeout <- GroupOut{Error: ErrGroupExists.Error()}
+					env.out <- made{err: ErrGroupExists}
+					continue
+				}
+				delete(msg.Roles, msg.Owner)
+				if err := msg.validRoles(); err != nil {
+					env.out <- made{err: err}
+					continue
+				}
+				if msg.size() > maxMeta {
+					env.out <- made{err: ErrTooLarge}
+					continue
+				}
+				msg.Created = time.Now().UTC()
+				msg.UUID = uuid.String()
+				b, _ := json.Marshal(&msg)
+				if err := s.Put(groupsBucket, msg.UUID, b); err != nil {
+					env.out <- made{err: err}
 					continue
 				}
-				dir[uuid] = msg.Members
+				dir[uuid] = msg
 				for _, fp := range msg.Members {
 					bdir[fp] = append(bdir[fp], uuid)
 				}
-				makeout <- GroupOut{UUID: uuid.String()}
-			case msg := <-listin:
-				us, ok := bdir[msg.SignedFingerPrint.FingerPrint]
+				env.out <- made{GroupOut{uuid.String()}, nil}
+			case env := <-listin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(ListIn)
+				lo := ListOut{[]Group{}}
+				for _, u := range bdir[msg.SignedFingerPrint.account()] {
+					lo.Groups = append(lo.Groups, dir[u])
+				}
+				env.out <- lo
+			case env := <-memin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(Reciept)
+				u, err := uuid.Parse(msg.Room)
+				if err != nil {
+					env.out <- membership{err: fmt.Errorf("%w: %s", ErrBadUUID, msg.Room)}
+					continue
+				}
+				g, ok := dir[u]
+				if !ok {
+					env.out <- membership{err: ErrNoSuchUUID}
+					continue
+				}
+				err = ErrNotMember
+				for _, fp := range g.Members {
+					if fp == msg.User {
+						err = nil
+						break
+					}
+				}
+				env.out <- membership{g, err}
+			case env := <-chin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(change)
+				u, err := uuid.Parse(msg.GroupID)
+				if err != nil {
+					env.out <- changed{err: fmt.Errorf("%w: %s", ErrBadUUID, msg.GroupID)}
+					continue
+				}
+				g, ok := dir[u]
 				if !ok {
-					listout <- ListOut{[]string{}}
+					env.out <- changed{err: ErrNoSuchUUID}
+					continue
+				}
+				if msg.Op == opAdd {
+					if err = devices(env, msg.Members); err != nil {
+						env.out <- changed{err: err}
+						continue
+					}
+				}
+				diff, err := msg.apply(&g)
+				if err != nil {
+					env.out <- changed{err: err}
+					continue
+				}
+				b, _ := json.Marshal(&g)
+				if err = s.Put(groupsBucket, g.UUID, b); err != nil {
+					env.out <- changed{err: err}
+					continue
+				}
+				dir[u] = g
+				for _, fp := range diff {
+					if msg.Op == opAdd {
+						bdir[fp] = append(bdir[fp], u)
+					} else if bdir[fp] = without(bdir[fp], u); len(bdir[fp]) == 0 {
+						delete(bdir, fp)
+					}
+				}
+				env.out <- changed{g, diff, nil}
+			case env := <-mvin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(move)
+				var out moved
+				var done []uuid.UUID
+				for _, u := range bdir[msg.Old] {
+					g := dir[u]
+					g.rename(msg.Old, msg.New)
+					b, _ := json.Marshal(&g)
+					if out.err = s.Put(groupsBucket, g.UUID, b); out.err != nil {
+						break
+					}
+					dir[u] = g
+					bdir[msg.New] = append(without(bdir[msg.New], u), u)
+					done = append(done, u)
+					out.Groups = append(out.Groups, g)
+				}
+				for _, u := range done {
+					if bdir[msg.Old] = without(bdir[msg.Old], u); len(bdir[msg.Old]) == 0 {
+						delete(bdir, msg.Old)
+					}
+				}
+				env.out <- out
+			case env := <-linkin:
+				if env.gone() {
+					continue
+				}
+				//Groups hold accounts, the key's own would be left behind
+				msg := env.in.(link)
+				if len(bdir[msg.Device]) != 0 {
+					env.out <- fmt.Errorf("%w: key is a member of groups", ErrNotAllowed)
+					continue
+				}
+				out, err := send(env.ctx, ctx.Done(), acctlinkin, msg)
+				if err == nil {
+					err, _ = out.(error)
+				}
+				env.out <- err
+			}
+		}
+	}()
+}
+
+//link asks for Device to be added to Account
+type link struct {
+	Account, Device FingerPrint
+}
+
+//linked is the account a device ended up on
+type linked struct {
+	Account FingerPrint
+	err     error
+}
+
+//unlinked is the result of unlinking a key, if it was an
+//account Orphans are the devices that were linked to it.
+type unlinked struct {
+	Orphans []FingerPrint
+	err     error
+}
+
+func loadAccounts(s Store) (map[FingerPrint]FingerPrint, map[FingerPrint][]FingerPrint, error) {
+	owner := make(map[FingerPrint]FingerPrint)
+	devices := make(map[FingerPrint][]FingerPrint)
+	err := s.ForEach(devicesBucket, func(k string, v []byte) error {
+		owner[FingerPrint(k)] = FingerPrint(v)
+		devices[FingerPrint(v)] = append(devices[FingerPrint(v)], FingerPrint(k))
+		return nil
+	})
+	return owner, devices, err
+}
+
+//accountProc keeps track of which device keys belong to
+//which account. An account is named by the FingerPrint of
+//its first key, keys that were never linked to another are
+//accounts of one device.
+func accountProc(ctx context.Context, wg *sync.WaitGroup, s Store, linkin, acctin, devin, mvin, unlinkin chan envelope, lin chan load) {
+	owner := make(map[FingerPrint]FingerPrint)     //Linked device to its account
+	devices := make(map[FingerPrint][]FingerPrint) //Account to its linked devices
+	unlink := func(d FingerPrint) error {
+		if err := s.Delete(devicesBucket, string(d)); err != nil {
+			return err
+		}
+		a := owner[d]
+		delete(owner, d)
+		if i := indexOf(devices[a], d); i >= 0 {
+			devices[a] = append(devices[a][:i:i], devices[a][i+1:]...)
+		}
+		if len(devices[a]) == 0 {
+			delete(devices, a)
+		}
+		return nil
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case l := <-lin:
+				o, d, err := loadAccounts(l.Store)
+				if err == nil {
+					s, owner, devices = l.Store, o, d
+				}
+				l.err <- err
+			case env := <-linkin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(link)
+				_, linked := owner[msg.Device]
+				_, isDevice := owner[msg.Account]
+				switch {
+				case linked:
+					env.out <- ErrLinked
+				case msg.Device == msg.Account || isDevice || len(devices[msg.Device]) != 0:
+					env.out <- ErrNotAllowed
+				default:
+					if err := s.Put(devicesBucket, string(msg.Device), []byte(msg.Account)); err != nil {
+						env.out <- err
+						continue
+					}
+					owner[msg.Device] = msg.Account
+					devices[msg.Account] = append(devices[msg.Account], msg.Device)
+					env.out <- nil
+				}
+			case env := <-acctin:
+				if env.gone() {
+					continue
+				}
+				fp := env.in.(FingerPrint)
+				if a, ok := owner[fp]; ok {
+					env.out <- a
+					continue
+				}
+				env.out <- fp
+			case env := <-devin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.([]FingerPrint)
+				//Linked devices are not accounts of their own
+				out := make(map[FingerPrint][]FingerPrint)
+				for _, fp := range msg {
+					if _, ok := owner[fp]; !ok {
+						out[fp] = append([]FingerPrint{fp}, devices[fp]...)
+					}
+				}
+				env.out <- out
+			case env := <-mvin:
+				if env.gone() {
+					continue
+				}
+				msg := env.in.(move)
+				if a, ok := owner[msg.Old]; ok {
+					//The new key is linked before the old one goes
+					//so a failure part way can be run again
+					err := s.Put(devicesBucket, string(msg.New), []byte(a))
+					if err == nil {
+						owner[msg.New] = a
+						if indexOf(devices[a], msg.New) < 0 {
+							devices[a] = append(devices[a], msg.New)
+						}
+						err = unlink(msg.Old)
+					}
+					env.out <- linked{a, err}
+					continue
+				}
+				if a, ok := owner[msg.New]; ok {
+					//A device that was already moved
+					env.out <- linked{a, nil}
+					continue
+				}
+				var err error
+				for _, d := range devices[msg.Old] {
+					if err = s.Put(devicesBucket, string(d), []byte(msg.New)); err != nil {
+						break
+					}
+					owner[d] = msg.New
+				}
+				if err == nil && len(devices[msg.Old]) != 0 {
+					devices[msg.New] = devices[msg.Old]
+					delete(devices, msg.Old)
+				}
+				env.out <- linked{msg.New, err}
+			case env := <-unlinkin:
+				if env.gone() {
+					continue
+				}
+				fp := env.in.(FingerPrint)
+				if _, ok := owner[fp]; ok {
+					env.out <- unlinked{err: unlink(fp)}
 					continue
 				}
-				lo := ListOut{}
-				for _, u := range us {
-					lo.GroupUUIDs = append(lo.GroupUUIDs, u.String())
+				//Without their account its devices are orphaned
+				out := unlinked{Orphans: devices[fp]}
+				for _, d := range out.Orphans {
+					if out.err = unlink(d); out.err != nil {
+						break
+					}
 				}
-				listout <- lo
+				env.out <- out
 			}
 		}
 	}()
-	return makeout, listout
 }
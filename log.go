@@ -1,8 +1,10 @@
 package ufo
 
 import (
+	"context"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 //Event is a log event
@@ -28,22 +30,33 @@ func log2page(ev []Event) string {
 	return b.String()
 }
 
-var eventOut = make(chan string)
-
-func logger(in chan Event) {
+func logger(ctx context.Context, wg *sync.WaitGroup, in chan Event) chan string {
+	out := make(chan string)
+	wg.Add(1)
 	go func() {
+		defer wg.Done()
 		evLog := []Event{}
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case e := <-in:
 				evLog = append(evLog, e)
-			case eventOut <- log2page(evLog):
+			case out <- log2page(evLog):
 			}
 		}
 	}()
+	return out
 }
 
 //LogHandler is the debug page for viewing errors
-func LogHandler(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte(<-eventOut))
+func (s *Server) LogHandler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case page := <-s.logout:
+		w.Write([]byte(page))
+	case <-s.ctx.Done():
+		s.fail(w, "Log", ErrClosed)
+	case <-r.Context().Done():
+		s.fail(w, "Log", r.Context().Err())
+	}
 }
@@ -1,11 +1,25 @@
 package ufo
 
+import "time"
+
 type (
-	//Sig is a base64 encoded PKCS1v15 signature
+	//Sig is a base64 encoded signature, see Algorithm
+	//for how each kind of key signs
 	Sig string
 
 	//FingerPrint is a SHA256 hash of PEM encoded public key */
 	FingerPrint string
+
+	//Role is what a member of a group is allowed to do
+	Role string
+)
+
+//Roles a member of a group can have
+const (
+	RoleOwner    Role = "owner"    //Everything an admin can, and make admins
+	RoleAdmin    Role = "admin"    //Add, remove and change the role of members
+	RoleMember   Role = "member"   //Read and write, the default
+	RoleReadOnly Role = "readonly" //Only read
 )
 
 //SignedFingerPrint is used to verify
@@ -13,25 +27,89 @@ type (
 type SignedFingerPrint struct {
 	FingerPrint         //Public key of user they claim to be
 	SignedChallenge Sig //Signature of sha256 encoded UUID challenge
+
+	//UUID of the challenge that was signed, if empty
+	//every outstanding challenge for the key is tried.
+	Challenge string `json:",omitempty"`
+
+	//Account the key belongs to, set by the server
+	//once the user is authenticated
+	Account FingerPrint `json:"-"`
 }
 
 //Group represents a group chat, identified by UUID
 type Group struct {
 	UUID    string        //UUID of group
 	Members []FingerPrint //Public keys of the members in that group
+	Owner   FingerPrint   `json:",omitempty"` //Creator, unless they hand it on
+
+	//Roles of members other than the owner,
+	//anyone not in it is a RoleMember.
+	Roles map[FingerPrint]Role `json:",omitempty"`
+
+	//Reciepts shares how far each member has
+	//acknowledged with everyone reading the group.
+	Reciepts bool `json:",omitempty"`
+
+	//Direct groups are the single conversation between
+	//two users, their members can not be changed.
+	Direct bool `json:",omitempty"`
+
+	GroupMeta
+	Created time.Time //Set by the server
+}
+
+//GroupMeta describes a group to its members. The server
+//never looks inside it, so clients may encrypt each field.
+type GroupMeta struct {
+	Name   string `json:",omitempty"`
+	Topic  string `json:",omitempty"`
+	Avatar string `json:",omitempty"` //Reference to the avatar blob
 }
 
 //Msg is a single message from or to a client
 type Msg struct {
-	From    FingerPrint //Sender's public key
+	ID      uint64      //Position in the group, starting at 1
+	Time    time.Time   //When the server received the message
+	From    FingerPrint //Sender's account
 	Content string      //Content of message
+
+	//System messages are written by the server to record
+	//changes to the group, From is who made the change.
+	System bool `json:",omitempty"`
+
+	Envelope *Envelope `json:",omitempty"`
+
+	//Nonce and Sig are the sender's signature of the
+	//message, it can be checked with Msg.Payload.
+	Nonce string `json:",omitempty"`
+	Sig   Sig    `json:",omitempty"`
+
+	//Device is the key the sender signed with,
+	//if it is not the first key of their account
+	Device FingerPrint `json:",omitempty"`
+
+	//Deleted messages keep their place but
+	//have had their content purged
+	Deleted bool `json:",omitempty"`
+}
+
+//Envelope is an end to end encrypted message. The content
+//is encrypted with a random key which is then wrapped with
+//the public key of every member of the group. Readers are
+//only sent the key wrapped for them.
+type Envelope struct {
+	Ciphertext string                 //Base64 encrypted content
+	Keys       map[FingerPrint]string //Base64 wrapped content key per recipient
 }
 
 //RegisterIn is the JSON object
 //for user registration.
 type RegisterIn struct {
-	Public string //Pem enoded public key
-	Sig    Sig    //Signature of the contents of Public
+	Public string    //Pem enoded public key
+	Sig    Sig       //Signature of the contents of Public
+	Alg    Algorithm `json:",omitempty"` //Optional, checked against Public
+	Scheme Scheme    `json:",omitempty"` //RSA signature scheme, PKCS1v15 if empty
 }
 
 //ChallengeIn is the JSON object
@@ -43,7 +121,21 @@ type ChallengeIn struct {
 //ChallengeOut is the JSON object
 //for challenge reuqest responses.
 type ChallengeOut struct {
-	UUID string //Plain text UUID that user must sign
+	UUID    string    //Plain text UUID that user must sign
+	Expires time.Time //Challenge can not be used after this
+}
+
+//SessionIn is the JSON object
+//for users to start a session.
+type SessionIn struct {
+	SignedFingerPrint
+}
+
+//SessionOut is the JSON object
+//response for session requests.
+type SessionOut struct {
+	Token   string    //Bearer token for the Authorization header
+	Expires time.Time //Token is not accepted after this
 }
 
 //ReadIn is the JSON object
@@ -51,21 +143,91 @@ type ChallengeOut struct {
 type ReadIn struct {
 	SignedFingerPrint
 	GroupID string
+
+	//Seconds to wait for a new message when there
+	//are none to read, at most MaxWait.
+	Wait int `json:",omitempty"`
+
+	//If either cursor is set only messages with IDs
+	//between them are read, and the users Reciept is
+	//left where it is. After may be 0 to read from the
+	//start of the group.
+	After  *uint64 `json:",omitempty"`
+	Before *uint64 `json:",omitempty"`
+
+	//Most messages to return, 0 for no limit.
+	Limit int `json:",omitempty"`
 }
 
 //ReadOut is the JSON object
 //response for read requests.
 type ReadOut struct {
 	Msgs []Msg
-	Err  error
+
+	//ID of the last message each member acknowledged,
+	//only set for groups that share Reciepts.
+	Reciepts map[FingerPrint]uint64 `json:",omitempty"`
+}
+
+//AckIn is the JSON object for users
+//to acknowledge reading messages.
+type AckIn struct {
+	SignedFingerPrint
+	GroupID string
+	ID      uint64 //Last message read, the next read starts after it
 }
 
 //WriteIn is the JSON object
 //for write requests.
 type WriteIn struct {
 	SignedFingerPrint
+	GroupID  string
+	Content  string    `json:",omitempty"`
+	Envelope *Envelope `json:",omitempty"` //Instead of Content
+
+	//Nonce is unique for each message the user sends
+	//to the group and Sig is their signature of Payload
+	Nonce string
+	Sig   Sig
+}
+
+//StreamIn is the JSON object
+//for users to open a stream.
+type StreamIn struct {
+	SignedFingerPrint
+}
+
+//StreamOut is the JSON object sent as
+//the data of each server sent event.
+type StreamOut struct {
 	GroupID string
-	Content string
+	Msg
+}
+
+//MemberIn is the JSON object for
+//changing the members of a group.
+type MemberIn struct {
+	SignedFingerPrint
+	GroupID string
+	Members []FingerPrint //Members to add or remove, unused to leave
+	Role    Role          `json:",omitempty"` //Role of added members
+}
+
+//RoleIn is the JSON object for
+//changing a member's role in a group.
+type RoleIn struct {
+	SignedFingerPrint
+	GroupID string
+	Member  FingerPrint
+	Role    Role //Making someone RoleOwner hands the group to them
+}
+
+//MetaIn is the JSON object for
+//updating a group's metadata.
+type MetaIn struct {
+	SignedFingerPrint
+	GroupID string
+	GroupMeta
 }
 
 //ListIn is the JSON object
@@ -78,7 +240,7 @@ type ListIn struct {
 //ListOut is the JSON object
 //response for list requests.
 type ListOut struct {
-	GroupUUIDs []string
+	Groups []Group
 }
 
 //GroupIn is the JSON object
@@ -89,16 +251,110 @@ type GroupIn struct {
 	SignedFingerPrint
 }
 
+//KeyIn is the JSON object for
+//looking up a user's public key
+type KeyIn struct {
+	FingerPrint
+}
+
+//KeyOut is a registered public key
+type KeyOut struct {
+	FingerPrint
+	Account FingerPrint `json:",omitempty"` //Account the key is a device of
+	Public  string      //PEM encoded, as it was registered
+	Alg     Algorithm
+	Scheme  Scheme `json:",omitempty"`
+
+	//The rotations this key took over from or handed on to
+	Succeeds    *Succession `json:",omitempty"`
+	SucceededBy *Succession `json:",omitempty"`
+}
+
+//Succession records a user handing their identity from
+//one key to the next. Sig is the old key's signature of
+//SuccessionPayload so anyone can check the chain.
+type Succession struct {
+	Old, New FingerPrint
+	Sig      Sig
+	Time     time.Time
+}
+
+//LinkIn is the JSON object for adding a device to an
+//account, it is authenticated as the new device. Approval
+//is the signature of LinkPayload by Approver, a device
+//already on the account.
+type LinkIn struct {
+	SignedFingerPrint
+	Approver FingerPrint
+	Approval Sig
+}
+
+//RevokeIn is the JSON object for revoking a key for good.
+//Sig is the key's signature of RevocationPayload, if Purge
+//is set every message the key wrote is deleted too.
+type RevokeIn struct {
+	SignedFingerPrint
+	Sig   Sig
+	Purge bool `json:",omitempty"`
+}
+
+//ClearIn is the JSON object for server admins to
+//let a revoked key register again
+type ClearIn struct {
+	SignedFingerPrint
+	Revoked FingerPrint
+}
+
+//RotateIn is the JSON object for rotating to a new key,
+//it is authenticated with the old key.
+type RotateIn struct {
+	SignedFingerPrint
+	New        RegisterIn //The new key, signed by itself
+	Succession Sig        //Signature of SuccessionPayload by the old key
+}
+
+//KeysIn is the JSON object for looking
+//up the keys of every member of a group
+type KeysIn struct {
+	SignedFingerPrint
+	GroupID string
+}
+
+//KeysOut is the JSON object
+//response for KeysIn requests
+type KeysOut struct {
+	Keys []KeyOut
+}
+
+//DMIn is the JSON object for
+//finding or starting the direct
+//conversation with Member
+type DMIn struct {
+	SignedFingerPrint
+	Member FingerPrint
+}
+
 //GroupOut is the JSON object
 //response for conversation
 //create requests.
 type GroupOut struct {
-	Error, UUID string
+	UUID string
+}
+
+//ErrorOut is the JSON object every endpoint
+//responds with when a request fails.
+type ErrorOut struct {
+	Code    string //Name of the error, such as "ErrNoSuchUUID"
+	Message string //Human readable, not to be matched on
+
+	//Unknown lists the members that are
+	//malformed or have no registered key
+	Unknown []FingerPrint `json:",omitempty"`
 }
 
 //Reciept is a mark in to the message
 //array for a conversation such that we
-//only send new "unread" messages
+//only send new "unacknowledged" messages
 type Reciept struct {
 	User FingerPrint
 	Room string
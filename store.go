@@ -0,0 +1,297 @@
+package ufo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//ErrStoreFailed is returned by every write to a FileStore
+//after a failed write could not be taken back out of its log
+var ErrStoreFailed = errors.New("Store failed")
+
+//Store is the persistent backing for ufo's state.
+//Values are grouped in to buckets and ForEach
+//visits a bucket in ascending key order.
+type Store interface {
+	Put(bucket, key string, value []byte) error
+	Delete(bucket, key string) error
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	Close() error
+}
+
+type memStore struct {
+	sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+//NewMemStore returns a Store that only lives in memory,
+//everything in it is lost when the process exits.
+func NewMemStore() Store {
+	return &memStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *memStore) put(bucket, key string, value []byte) {
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	b[key] = append([]byte(nil), value...)
+}
+
+func (m *memStore) del(bucket, key string) {
+	delete(m.buckets[bucket], key)
+}
+
+func (m *memStore) Put(bucket, key string, value []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	m.put(bucket, key, value)
+	return nil
+}
+
+func (m *memStore) Delete(bucket, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.del(bucket, key)
+	return nil
+}
+
+func (m *memStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	//Take a copy so fn is free to write back to the store
+	m.Lock()
+	b := m.buckets[bucket]
+	keys := make([]string, 0, len(b))
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		vals[i] = b[k]
+	}
+	m.Unlock()
+
+	for i, k := range keys {
+		if err := fn(k, vals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memStore) Close() error {
+	return nil
+}
+
+func (m *memStore) len() int {
+	n := 0
+	for _, b := range m.buckets {
+		n += len(b)
+	}
+	return n
+}
+
+const (
+	opPut = "put"
+	opDel = "del"
+)
+
+//entry is a single line in a FileStore's log
+type entry struct {
+	Op, Bucket, Key string
+	Value           []byte `json:",omitempty"`
+}
+
+//FileStore is a Store backed by an append only log on disk.
+//Every change is synced to disk before Put or Delete return,
+//one that fails is cut back out of the log. The whole log is
+//replayed in to memory when it is opened.
+type FileStore struct {
+	mem    *memStore
+	path   string
+	f      *os.File
+	end    int64 //Offset past the last whole entry
+	broken error //Set once the log can not be trusted
+}
+
+//OpenFileStore opens or creates the log at path and
+//recovers its contents. A partially written final entry,
+//as left by a crash, is discarded.
+func OpenFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		mem:  NewMemStore().(*memStore),
+		path: path,
+		f:    f,
+	}
+	entries, err := fs.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	//Reclaim space once most of the log is overwritten history
+	if entries > 1024 && entries > 2*fs.mem.len() {
+		if err = fs.compact(); err != nil {
+			fs.f.Close()
+			return nil, err
+		}
+	}
+	if fs.end, err = fs.f.Seek(0, io.SeekEnd); err != nil {
+		fs.f.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) apply(e *entry) {
+	switch e.Op {
+	case opPut:
+		fs.mem.put(e.Bucket, e.Key, e.Value)
+	case opDel:
+		fs.mem.del(e.Bucket, e.Key)
+	}
+}
+
+func (fs *FileStore) replay() (int, error) {
+	r := bufio.NewReader(fs.f)
+	var good int64
+	var entries int
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) != 0 {
+				//Torn write from a crash, drop it
+				return entries, fs.f.Truncate(good)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		var e entry
+		if err = json.Unmarshal(line, &e); err != nil {
+			return entries, err
+		}
+		fs.apply(&e)
+		good += int64(len(line))
+		entries++
+	}
+}
+
+func (fs *FileStore) compact() error {
+	tmp := fs.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for bucket, b := range fs.mem.buckets {
+		for k, v := range b {
+			line, _ := json.Marshal(&entry{opPut, bucket, k, v})
+			w.Write(line)
+			w.WriteByte('\n')
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	fs.f.Close()
+	if err = os.Rename(tmp, fs.path); err != nil {
+		return err
+	}
+	fs.f, err = os.OpenFile(fs.path, os.O_RDWR, 0600)
+	return err
+}
+
+func (fs *FileStore) write(e *entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	fs.mem.Lock()
+	defer fs.mem.Unlock()
+	if fs.broken != nil {
+		return fs.broken
+	}
+	line = append(line, '\n')
+	if _, err = fs.f.Write(line); err == nil {
+		err = fs.f.Sync()
+	}
+	if err != nil {
+		//Cut off whatever part of the line made it to disk,
+		//the next entry would otherwise follow a torn one
+		if rerr := fs.rollback(); rerr != nil {
+			fs.broken = fmt.Errorf("%w: %v", ErrStoreFailed, rerr)
+		}
+		return err
+	}
+	fs.end += int64(len(line))
+	fs.apply(e)
+	return nil
+}
+
+//rollback truncates the log back to its last whole entry
+func (fs *FileStore) rollback() error {
+	if err := fs.f.Truncate(fs.end); err != nil {
+		return err
+	}
+	if _, err := fs.f.Seek(fs.end, io.SeekStart); err != nil {
+		return err
+	}
+	return fs.f.Sync()
+}
+
+//Put stores value under key in bucket
+func (fs *FileStore) Put(bucket, key string, value []byte) error {
+	return fs.write(&entry{opPut, bucket, key, value})
+}
+
+//Delete removes key from bucket
+func (fs *FileStore) Delete(bucket, key string) error {
+	return fs.write(&entry{Op: opDel, Bucket: bucket, Key: key})
+}
+
+//ForEach calls fn for every key in bucket in ascending order
+func (fs *FileStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return fs.mem.ForEach(bucket, fn)
+}
+
+//Close syncs and closes the underlying log
+func (fs *FileStore) Close() error {
+	fs.mem.Lock()
+	defer fs.mem.Unlock()
+	if err := fs.f.Sync(); err != nil {
+		fs.f.Close()
+		return err
+	}
+	return fs.f.Close()
+}
+
+var _ Store = (*FileStore)(nil)
+
+//keysplit splits a compound store key of the form a/b
+func keysplit(key string) (string, string) {
+	i := strings.IndexByte(key, '/')
+	if i < 0 {
+		return key, ""
+	}
+	return key[:i], key[i+1:]
+}
@@ -0,0 +1,298 @@
+package ufo_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/SD-Paranoia/ufo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempStore(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ufo")
+	require.Nil(t, err)
+	return filepath.Join(dir, "ufo.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestFileStore(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	fs, err := ufo.OpenFileStore(path)
+	require.Nil(t, err)
+	require.Nil(t, fs.Put("a", "2", []byte("two")))
+	require.Nil(t, fs.Put("a", "1", []byte("one")))
+	require.Nil(t, fs.Put("b", "1", []byte("other")))
+	require.Nil(t, fs.Put("a", "3", []byte("three")))
+	require.Nil(t, fs.Delete("a", "3"))
+	require.Nil(t, fs.Close())
+
+	//Simulate a crash half way through a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.Nil(t, err)
+	_, err = f.Write([]byte(`{"Op":"put","Buck`))
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	fs, err = ufo.OpenFileStore(path)
+	require.Nil(t, err)
+	defer fs.Close()
+	var keys, vals []string
+	require.Nil(t, fs.ForEach("a", func(k string, v []byte) error {
+		keys = append(keys, k)
+		vals = append(vals, string(v))
+		return nil
+	}))
+	assert.Equal(t, []string{"1", "2"}, keys)
+	assert.Equal(t, []string{"one", "two"}, vals)
+
+	require.Nil(t, fs.Put("a", "4", []byte("four")))
+	n := 0
+	require.Nil(t, fs.ForEach("a", func(string, []byte) error { n++; return nil }))
+	assert.Equal(t, 3, n)
+}
+
+func TestFileStoreFailed(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	fs, err := ufo.OpenFileStore(path)
+	require.Nil(t, err)
+	require.Nil(t, fs.Put("a", "1", []byte("one")))
+	require.Nil(t, fs.Close())
+
+	//The write can not be taken back out of the log either,
+	//so the store refuses everything after it
+	err = fs.Put("a", "2", []byte("two"))
+	require.NotNil(t, err)
+	assert.False(t, errors.Is(err, ufo.ErrStoreFailed))
+	assert.True(t, errors.Is(fs.Put("a", "3", []byte("three")), ufo.ErrStoreFailed))
+	assert.True(t, errors.Is(fs.Delete("a", "1"), ufo.ErrStoreFailed))
+	n := 0
+	require.Nil(t, fs.ForEach("a", func(string, []byte) error { n++; return nil }))
+	assert.Equal(t, 1, n)
+
+	fs, err = ufo.OpenFileStore(path)
+	require.Nil(t, err)
+	defer fs.Close()
+	require.Nil(t, fs.Put("a", "2", []byte("two")))
+}
+
+func TestRecovery(t *testing.T) {
+	srv := ufo.New()
+	defer srv.Close()
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	fs, err := ufo.OpenFileStore(path)
+	require.Nil(t, err)
+	require.Nil(t, srv.Load(fs))
+
+	pub, sig, kp := register(t, srv)
+	fp := makeFingerPrint(pub)
+	gin := &ufo.GroupIn{
+		Group:             ufo.Group{Members: []ufo.FingerPrint{fp}},
+		SignedFingerPrint: sign(t, srv, pub, kp),
+	}
+	b, err := json.Marshal(gin)
+	require.Nil(t, err)
+	w := httptest.NewRecorder()
+	srv.MakeConvoHandler(w, httptest.NewRequest(http.MethodPost, "/convo", bytes.NewBuffer(b)))
+	require.Equal(t, 200, w.Result().StatusCode)
+	gout := &ufo.GroupOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), gout))
+
+	win := signWrite(t, kp, &ufo.WriteIn{SignedFingerPrint: sign(t, srv, pub, kp), GroupID: gout.UUID, Content: "persisted"})
+	b, err = json.Marshal(win)
+	require.Nil(t, err)
+	w = httptest.NewRecorder()
+	srv.WriteHandler(w, httptest.NewRequest(http.MethodPost, "/write", bytes.NewBuffer(b)))
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	//Restart on a fresh copy of the log, closing
+	//the server closes the store it was given
+	require.Nil(t, srv.Close())
+	fs, err = ufo.OpenFileStore(path)
+	require.Nil(t, err)
+	srv = ufo.New()
+	defer srv.Close()
+	require.Nil(t, srv.Load(fs))
+
+	t.Run("key", func(t *testing.T) {
+		w := post(t, srv.RegisterInHandler, "/reg", &ufo.RegisterIn{Public: pub, Sig: ufo.Sig(sig)})
+		assert.Equal(t, 409, w.Code)
+		assert.Equal(t, "ErrKeyExists", failure(t, w).Code)
+	})
+
+	t.Run("group", func(t *testing.T) {
+		b, err := json.Marshal(&ufo.ListIn{sign(t, srv, pub, kp)})
+		require.Nil(t, err)
+		w := httptest.NewRecorder()
+		srv.ListHandler(w, httptest.NewRequest(http.MethodPost, "/list", bytes.NewBuffer(b)))
+		require.Equal(t, 200, w.Result().StatusCode)
+		lout := &ufo.ListOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+		require.Equal(t, 1, len(lout.Groups))
+		assert.Equal(t, gout.UUID, lout.Groups[0].UUID)
+	})
+
+	t.Run("msgs", func(t *testing.T) {
+		b, err := json.Marshal(&ufo.ReadIn{SignedFingerPrint: sign(t, srv, pub, kp), GroupID: gout.UUID})
+		require.Nil(t, err)
+		w := httptest.NewRecorder()
+		srv.ReadHandler(w, httptest.NewRequest(http.MethodPost, "/read", bytes.NewBuffer(b)))
+		require.Equal(t, 200, w.Result().StatusCode)
+		rout := &ufo.ReadOut{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), rout))
+		require.Equal(t, 1, len(rout.Msgs))
+		assert.Equal(t, "persisted", rout.Msgs[0].Content)
+		assert.Equal(t, fp, rout.Msgs[0].From)
+	})
+}
+
+//failStore is a Store whose every change fails with err
+type failStore struct {
+	ufo.Store
+	err error
+}
+
+func (fs failStore) Put(string, string, []byte) error { return fs.err }
+
+func (fs failStore) Delete(string, string) error { return fs.err }
+
+func TestStoreErrors(t *testing.T) {
+	pub, sig, _ := genKeyPartsRSA(t)
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errors.New("disk on fire"), 500, "ErrInternal"},
+		{fmt.Errorf("%w: disk on fire", ufo.ErrStoreFailed), 503, "ErrStoreFailed"},
+	} {
+		srv := ufo.New()
+		require.Nil(t, srv.Load(failStore{ufo.NewMemStore(), tc.err}))
+		w := post(t, srv.RegisterInHandler, "/reg", &ufo.RegisterIn{Public: pub, Sig: ufo.Sig(sig)})
+		assert.Equal(t, tc.status, w.Code)
+		out := failure(t, w)
+		assert.Equal(t, tc.code, out.Code)
+		assert.NotContains(t, out.Message, "disk on fire")
+		require.Nil(t, srv.Close())
+	}
+}
+
+//flakyStore is a Store whose changes to bucket
+//fail with err while it is set
+type flakyStore struct {
+	ufo.Store
+	mu     sync.Mutex
+	bucket string
+	err    error
+}
+
+func (fs *flakyStore) fail(bucket string, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.bucket, fs.err = bucket, err
+}
+
+func (fs *flakyStore) failing(bucket string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if bucket == fs.bucket {
+		return fs.err
+	}
+	return nil
+}
+
+func (fs *flakyStore) Put(bucket, key string, value []byte) error {
+	if err := fs.failing(bucket); err != nil {
+		return err
+	}
+	return fs.Store.Put(bucket, key, value)
+}
+
+func (fs *flakyStore) Delete(bucket, key string) error {
+	if err := fs.failing(bucket); err != nil {
+		return err
+	}
+	return fs.Store.Delete(bucket, key)
+}
+
+func TestRotateRetry(t *testing.T) {
+	st := &flakyStore{Store: ufo.NewMemStore()}
+	srv := ufo.New()
+	defer srv.Close()
+	require.Nil(t, srv.Load(st))
+	pubA, _, kpA := register(t, srv)
+	pubB, _, _ := register(t, srv)
+	fpA, fpB := makeFingerPrint(pubA), makeFingerPrint(pubB)
+	tokA := startSession(t, srv, pubA, kpA)
+	group := makeGroup(t, srv, tokA, fpB)
+
+	pubN, sigN, kpN := genKeyPartsRSA(t)
+	fpN := makeFingerPrint(pubN)
+	in := &ufo.RotateIn{
+		New:        ufo.RegisterIn{Public: pubN, Sig: ufo.Sig(sigN)},
+		Succession: signAny(t, kpA, ufo.SuccessionPayload(fpA, fpN)),
+	}
+	st.fail("groups", errors.New("disk on fire"))
+	w := postAuth(t, srv.RotateHandler, "/rotate", tokA, in)
+	assert.Equal(t, 500, w.Code)
+	st.fail("", nil)
+
+	//Only the same succession can be repeated
+	pubM, sigM, _ := genKeyPartsRSA(t)
+	w = post(t, srv.RotateHandler, "/rotate", &ufo.RotateIn{
+		SignedFingerPrint: sign(t, srv, pubA, kpA),
+		New:               ufo.RegisterIn{Public: pubM, Sig: ufo.Sig(sigM)},
+		Succession:        signAny(t, kpA, ufo.SuccessionPayload(fpA, makeFingerPrint(pubM))),
+	})
+	assert.Equal(t, 401, w.Code)
+	in.SignedFingerPrint = sign(t, srv, pubA, kpA)
+	w = post(t, srv.RotateHandler, "/rotate", in)
+	require.Equal(t, 200, w.Code)
+
+	tokN := startSession(t, srv, pubN, kpN)
+	w = postAuth(t, srv.ListHandler, "/list", tokN, &ufo.ListIn{})
+	lout := &ufo.ListOut{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), lout))
+	require.Equal(t, 1, len(lout.Groups))
+	assert.Equal(t, group, lout.Groups[0].UUID)
+	assert.Equal(t, []ufo.FingerPrint{fpN, fpB}, lout.Groups[0].Members)
+}
+
+func TestRevokeFailed(t *testing.T) {
+	st := &flakyStore{Store: ufo.NewMemStore()}
+	srv := ufo.New()
+	defer srv.Close()
+	require.Nil(t, srv.Load(st))
+	pubA, _, kpA := register(t, srv)
+	pubL, _, kpL := register(t, srv)
+	fpA, fpL := makeFingerPrint(pubA), makeFingerPrint(pubL)
+	tokA, tokL := startSession(t, srv, pubA, kpA), startSession(t, srv, pubL, kpL)
+	w := postAuth(t, srv.LinkHandler, "/link", tokL, &ufo.LinkIn{Approver: fpA, Approval: signAny(t, kpA, ufo.LinkPayload(fpA, fpL))})
+	require.Equal(t, 200, w.Code)
+
+	//Neither the account nor its device is left half revoked
+	st.fail("revoked", errors.New("disk on fire"))
+	in := &ufo.RevokeIn{Sig: signAny(t, kpA, ufo.RevocationPayload(fpA))}
+	assert.Equal(t, 500, postAuth(t, srv.RevokeHandler, "/revoke", tokA, in).Code)
+	st.fail("", nil)
+	w = postAuth(t, srv.ListHandler, "/list", tokL, &ufo.ListIn{})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 200, postAuth(t, srv.RevokeHandler, "/revoke", tokA, in).Code)
+	assert.Equal(t, 401, postAuth(t, srv.ListHandler, "/list", tokL, &ufo.ListIn{}).Code)
+	assert.Equal(t, 404, post(t, srv.ChallengeHandler, "/chal", &ufo.ChallengeIn{fpL}).Code)
+}